@@ -0,0 +1,234 @@
+/*
+* Copyright 2023-2025 Thorsten A. Knieling
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*    http://www.apache.org/licenses/LICENSE-2.0
+*
+ */
+
+package mqtt2db
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/tknie/flynn/common"
+	"github.com/tknie/log"
+	"github.com/tknie/services"
+)
+
+const (
+	windowStartColumn = "window_start"
+	windowEndColumn   = "window_end"
+)
+
+var aggregateSuffixes = []string{"_count", "_min", "_max", "_avg", "_first", "_last"}
+
+// Aggregate tumbling window aggregation of a topic. Instead of a row per
+// message one row per window and device is stored containing count, min,
+// max, mean, first and last value of each numeric column.
+type Aggregate struct {
+	Window       time.Duration `yaml:"window"`
+	DeviceColumn string        `yaml:"deviceColumn,omitempty"`
+}
+
+type aggregateValue struct {
+	count uint64
+	min   float64
+	max   float64
+	sum   float64
+	first float64
+	last  float64
+}
+
+type aggregateWindow struct {
+	start  time.Time
+	values map[string]*aggregateValue
+	other  map[string]interface{}
+}
+
+type aggregator struct {
+	lock    sync.Mutex
+	windows map[string]*aggregateWindow
+}
+
+func (agg *Aggregate) check(topicName, rawColumn string) error {
+	if agg.Window <= 0 {
+		return fmt.Errorf("aggregate window missing for topic '%s'", topicName)
+	}
+	if rawColumn != "" {
+		return fmt.Errorf("rawColumn not valid with aggregate for topic '%s'", topicName)
+	}
+	return nil
+}
+
+// aggregateColumns create columns of the aggregation table
+func (topic *Topic) aggregateColumns() []*common.Column {
+	columns := []*common.Column{
+		{Name: windowStartColumn, DataType: common.CurrentTimestamp},
+		{Name: windowEndColumn, DataType: common.CurrentTimestamp},
+	}
+	if topic.Aggregate.DeviceColumn != "" {
+		columns = append(columns, &common.Column{Name: topic.Aggregate.DeviceColumn, DataType: common.Alpha, Length: 255})
+	}
+	added := make([]string, 0)
+	for _, m := range topic.Mapping {
+		for _, destination := range topic.columnDestinations(&m) {
+			if slices.Contains(added, destination) {
+				continue
+			}
+			added = append(added, destination)
+			switch m.mtype.name {
+			case "int32", "int64", "float64", "decimal":
+				for _, suffix := range aggregateSuffixes {
+					switch suffix {
+					case "_count":
+						columns = append(columns, &common.Column{Name: destination + suffix, DataType: common.BigInteger})
+					case "_avg":
+						columns = append(columns, &common.Column{Name: destination + suffix, DataType: common.Decimal,
+							Length: defaultDecimalLength, Digits: defaultDecimalDigits})
+					default:
+						columns = append(columns, m.mtype.column(destination+suffix))
+					}
+				}
+			case "time.Time":
+			default:
+				columns = append(columns, m.mtype.column(destination))
+			}
+		}
+	}
+	for _, cc := range topic.counterColumns() {
+		for _, suffix := range aggregateSuffixes {
+			if suffix == "_count" {
+				columns = append(columns, &common.Column{Name: cc.Name + suffix, DataType: common.BigInteger})
+				continue
+			}
+			columns = append(columns, &common.Column{Name: cc.Name + suffix, DataType: cc.DataType,
+				Length: cc.Length, Digits: cc.Digits})
+		}
+	}
+	return columns
+}
+
+// aggregate add the entry to the window of the device. Windows ended before
+// the entry are flushed.
+func (topic *Topic) aggregate(device string, e map[string]interface{}, received time.Time) {
+	t := received
+	if topic.Timestamp != nil {
+		if ts, ok := e[topic.Timestamp.Destination].(time.Time); ok {
+			t = ts
+		}
+	}
+	agg := topic.aggregator
+	agg.lock.Lock()
+	defer agg.lock.Unlock()
+	start := t.Truncate(topic.Aggregate.Window)
+	w, ok := agg.windows[device]
+	if ok && !w.start.Equal(start) {
+		topic.storeWindow(device, w)
+		ok = false
+	}
+	if !ok {
+		w = &aggregateWindow{start: start, values: make(map[string]*aggregateValue),
+			other: make(map[string]interface{})}
+		agg.windows[device] = w
+	}
+	for k, v := range e {
+		var f float64
+		switch n := v.(type) {
+		case int32:
+			f = float64(n)
+		case int64:
+			f = float64(n)
+		case float64:
+			f = n
+		case time.Time, nil:
+			continue
+		default:
+			w.other[k] = v
+			continue
+		}
+		av, ok := w.values[k]
+		if !ok {
+			w.values[k] = &aggregateValue{count: 1, min: f, max: f, sum: f, first: f, last: f}
+			continue
+		}
+		av.count++
+		av.min = math.Min(av.min, f)
+		av.max = math.Max(av.max, f)
+		av.sum += f
+		av.last = f
+	}
+}
+
+// flushAggregates store all windows ended before the given time. If force
+// is set all windows are stored.
+func (topic *Topic) flushAggregates(now time.Time, force bool) {
+	agg := topic.aggregator
+	if agg == nil {
+		return
+	}
+	agg.lock.Lock()
+	defer agg.lock.Unlock()
+	for device, w := range agg.windows {
+		if force || !now.Before(w.start.Add(topic.Aggregate.Window)) {
+			topic.storeWindow(device, w)
+			delete(agg.windows, device)
+		}
+	}
+}
+
+func (topic *Topic) storeWindow(device string, w *aggregateWindow) {
+	row := make(map[string]interface{})
+	row[windowStartColumn] = w.start
+	row[windowEndColumn] = w.start.Add(topic.Aggregate.Window)
+	if topic.Aggregate.DeviceColumn != "" {
+		row[topic.Aggregate.DeviceColumn] = device
+	}
+	for k, v := range w.other {
+		row[k] = v
+	}
+	for k, av := range w.values {
+		row[k+"_count"] = int64(av.count)
+		row[k+"_min"] = av.min
+		row[k+"_max"] = av.max
+		row[k+"_avg"] = av.sum / float64(av.count)
+		row[k+"_first"] = av.first
+		row[k+"_last"] = av.last
+	}
+	log.Log.Debugf("Store window %s of %s: %v", w.start.Format(layout), device, row)
+	topic.storeEvent(row)
+}
+
+// loopAggregateFlush periodically store all ended windows of the topics
+func (s *Service) loopAggregateFlush(topics []*Topic) {
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-time.After(10 * time.Second):
+			now := time.Now()
+			for _, topic := range topics {
+				if topic.Aggregate != nil {
+					topic.flushAggregates(now, false)
+				}
+			}
+		}
+	}
+}
+
+// FlushAggregates store all open aggregation windows, used on shutdown
+func (s *Service) FlushAggregates() {
+	for _, topic := range s.config.Mapping.Topic {
+		if topic.Aggregate != nil {
+			services.ServerMessage("Flush aggregation windows of topic %s", topic.Name)
+			topic.flushAggregates(time.Now(), true)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+/*
+* Copyright 2023-2025 Thorsten A. Knieling
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*    http://www.apache.org/licenses/LICENSE-2.0
+*
+ */
+
+package mqtt2db
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/tknie/log"
+	"github.com/tknie/services"
+)
+
+const (
+	staleCheckInterval = 10 * time.Second
+	webhookTimeout     = 10 * time.Second
+)
+
+const (
+	alertStale     = "stale"
+	alertRecovered = "recovered"
+)
+
+// Alert destination of staleness alerts. Alerts are always logged and can
+// be published to a MQTT topic or posted to a webhook.
+type Alert struct {
+	Topic   string `yaml:"topic,omitempty"`
+	Webhook string `yaml:"webhook,omitempty"`
+}
+
+type alertEntry struct {
+	Topic       string    `json:"topic"`
+	State       string    `json:"state"`
+	Silence     string    `json:"silence"`
+	MaxSilence  string    `json:"maxSilence"`
+	LastMessage time.Time `json:"lastMessage,omitzero"`
+	Time        time.Time `json:"time"`
+}
+
+// loopStaleness periodically check all topics with maximum silence
+func (s *Service) loopStaleness(topics []*Topic) {
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-time.After(staleCheckInterval):
+			for _, topic := range topics {
+				topic.checkStaleness(time.Now())
+			}
+		}
+	}
+}
+
+// checkStaleness alert if the topic is silent longer than its maximum
+// silence or if messages are received again
+func (topic *Topic) checkStaleness(now time.Time) {
+	if topic.MaxSilence == 0 {
+		return
+	}
+	s := topic.service
+	m := topic.metrics()
+	silence := topic.silence(now)
+	stale := silence > topic.MaxSilence
+	if m.stale.Swap(stale) == stale {
+		return
+	}
+	entry := &alertEntry{Topic: topic.Name, State: alertRecovered, Silence: silence.Round(time.Second).String(),
+		MaxSilence: topic.MaxSilence.String(), Time: now}
+	if l := m.lastMessage.Load(); l > 0 {
+		entry.LastMessage = time.Unix(0, l)
+	}
+	if stale {
+		entry.State = alertStale
+		m.alerts.Add(1)
+		services.ServerMessage("Topic %s is silent for %s (maximum %s)", topic.Name, entry.Silence, entry.MaxSilence)
+	} else {
+		services.ServerMessage("Topic %s receives messages again", topic.Name)
+	}
+	alert := topic.Alert
+	if alert == nil {
+		alert = s.config.Mapping.Alert
+	}
+	if alert != nil {
+		s.sendAlert(alert, entry)
+	}
+}
+
+func (s *Service) sendAlert(alert *Alert, entry *alertEntry) {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		log.Log.Errorf("Error marshal alert: %v", err)
+		return
+	}
+	if alert.Topic != "" {
+		err = s.publish(alert.Topic, b)
+		if err != nil {
+			log.Log.Errorf("Error publishing alert to %s: %v", alert.Topic, err)
+		}
+	}
+	if alert.Webhook != "" {
+		go postWebhook(alert.Webhook, b)
+	}
+}
+
+func postWebhook(url string, b []byte) {
+	client := &http.Client{Timeout: webhookTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		log.Log.Errorf("Error posting alert to %s: %v", url, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Log.Errorf("Error posting alert to %s: status %s", url, resp.Status)
+	}
+}
@@ -0,0 +1,438 @@
+/*
+* Copyright 2023-2025 Thorsten A. Knieling
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*    http://www.apache.org/licenses/LICENSE-2.0
+*
+ */
+
+package mqtt2db
+
+import (
+	"compress/gzip"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/tknie/flynn/common"
+	"github.com/tknie/log"
+	"github.com/tknie/services"
+)
+
+// archive file formats
+const (
+	ArchiveCSV     = "csv"
+	ArchiveParquet = "parquet"
+)
+
+const (
+	dayLayout         = "2006-01-02"
+	defaultArchiveDir = "archive"
+)
+
+type archiveWriter struct {
+	format   string
+	dir      string
+	table    string
+	day      string
+	fields   []string
+	rows     [][]any
+	files    int
+	verified int64
+}
+
+// Archive export all rows of the topic stored before the day of the cutoff
+// into compressed Parquet or CSV files per day below the directory. The
+// number of rows in the files is verified against the database. With
+// remove the exported rows are deleted afterwards.
+func (s *Service) Archive(name string, cutoff time.Time, format, dir string, remove bool) error {
+	topic := s.findTopic(name)
+	if topic == nil {
+		return fmt.Errorf("topic '%s' not found", name)
+	}
+	switch format {
+	case "":
+		format = ArchiveParquet
+	case ArchiveCSV, ArchiveParquet:
+	default:
+		return fmt.Errorf("unknown archive format '%s'", format)
+	}
+	if dir == "" {
+		dir = defaultArchiveDir
+	}
+	id, release, err := s.handler()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	cutoff, _ = periodStart("day", cutoff)
+	tables, err := topic.queryTables(id)
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		err = archiveTable(id, s.driver, table, topic.storeTimeColumn(), cutoff, format, dir, remove)
+		if err != nil {
+			return fmt.Errorf("archive of %s: %v", table, err)
+		}
+	}
+	return nil
+}
+
+// Archive archive the topic of the default service
+func Archive(name string, cutoff time.Time, format, dir string, remove bool) error {
+	return defaultService.Archive(name, cutoff, format, dir, remove)
+}
+
+func archiveTable(id DatabaseClient, driver common.ReferenceType, table, column string, cutoff time.Time, format, dir string, remove bool) error {
+	services.ServerMessage("Archive rows of %s before %s", table, cutoff.Format(dayLayout))
+	w := &archiveWriter{format: format, dir: dir, table: table}
+	index := -1
+	query := &common.Query{
+		TableName: table,
+		Fields:    []string{"*"},
+		Search:    fmt.Sprintf("%s < '%s'", column, sqlTime(id, cutoff, sqlTimeLayout)),
+		Order:     []string{column + ":ASC"},
+	}
+	_, err := id.Query(query, func(search *common.Query, result *common.Result) error {
+		if index < 0 {
+			index = slices.IndexFunc(result.Fields, func(s string) bool { return strings.EqualFold(s, column) })
+			if index < 0 {
+				return fmt.Errorf("time column %s not found", column)
+			}
+		}
+		row := make([]any, len(result.Rows))
+		for i, v := range result.Rows {
+			row[i] = columnValue(v)
+		}
+		t, ok := row[index].(time.Time)
+		if !ok {
+			return fmt.Errorf("column %s is not a time stamp: %T", column, row[index])
+		}
+		if day := t.Format(dayLayout); day != w.day {
+			if err := w.flush(); err != nil {
+				return err
+			}
+			w.day = day
+			w.fields = result.Fields
+		}
+		w.rows = append(w.rows, row)
+		return nil
+	})
+	if err == nil {
+		err = w.flush()
+	}
+	if err != nil {
+		return err
+	}
+	p := &retentionPolicy{table: table, column: column, batchSize: defaultRetentionBatchSize, driver: driver}
+	count, err := p.count(id, cutoff)
+	if err != nil {
+		return err
+	}
+	if count != w.verified {
+		return fmt.Errorf("%d rows in database but %d rows in archive files", count, w.verified)
+	}
+	services.ServerMessage("Archived %d rows of %s into %d files", count, table, w.files)
+	if !remove || count == 0 {
+		return nil
+	}
+	n, err := p.apply(id, cutoff)
+	if err != nil {
+		return err
+	}
+	services.ServerMessage("Deleted %d archived rows of %s", n, table)
+	return nil
+}
+
+// flush write the rows of the current day into the archive file and
+// verify the number of rows written
+func (w *archiveWriter) flush() error {
+	if len(w.rows) == 0 {
+		return nil
+	}
+	base := filepath.Join(w.dir, w.table, w.day[:4], w.day[5:7], w.table+"_"+w.day)
+	err := os.MkdirAll(filepath.Dir(base), 0755)
+	if err != nil {
+		return err
+	}
+	ext := ".parquet"
+	if w.format == ArchiveCSV {
+		ext = ".csv.gz"
+	}
+	f, name, err := createArchive(base, ext)
+	if err != nil {
+		return err
+	}
+	var n int64
+	if w.format == ArchiveCSV {
+		err = writeCSV(f, w.fields, w.rows)
+		if err == nil {
+			n, err = countCSV(name)
+		}
+	} else {
+		err = writeParquet(f, w.table, w.fields, w.rows)
+		if err == nil {
+			n, err = countParquet(name)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("archive file %s: %v", name, err)
+	}
+	if n != int64(len(w.rows)) {
+		return fmt.Errorf("archive file %s contains %d of %d rows", name, n, len(w.rows))
+	}
+	log.Log.Debugf("Archive file %s written with %d rows", name, n)
+	w.files++
+	w.verified += n
+	w.rows = nil
+	return nil
+}
+
+// createArchive create a new archive file. An existing archive of the day,
+// e.g. of rows imported after the day was archived, is kept and the new
+// file gets a '_<n>' suffix.
+func createArchive(base, ext string) (*os.File, string, error) {
+	name := base + ext
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	for i := 1; os.IsExist(err); i++ {
+		name = fmt.Sprintf("%s_%d%s", base, i, ext)
+		f, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return f, name, nil
+}
+
+func writeCSV(f *os.File, fields []string, rows [][]any) error {
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	cw := csv.NewWriter(gz)
+	err := cw.Write(fields)
+	record := make([]string, len(fields))
+	for _, row := range rows {
+		if err != nil {
+			return err
+		}
+		for i, v := range row {
+			record[i] = formatValue(v)
+		}
+		err = cw.Write(record)
+	}
+	cw.Flush()
+	if err == nil {
+		err = cw.Error()
+	}
+	if err != nil {
+		return err
+	}
+	err = gz.Close()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func countCSV(name string) (int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return 0, err
+	}
+	cr := csv.NewReader(gz)
+	n := int64(-1)
+	for {
+		_, err = cr.Read()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		n++
+	}
+}
+
+// parquetKind column kind inferred by the first value not NULL
+func parquetKind(rows [][]any, i int) (parquet.Node, string) {
+	for _, row := range rows {
+		switch row[i].(type) {
+		case nil:
+			continue
+		case time.Time:
+			return parquet.Timestamp(parquet.Microsecond), "time"
+		case bool:
+			return parquet.Leaf(parquet.BooleanType), "bool"
+		case int64:
+			return parquet.Int(64), "int"
+		case float64:
+			return parquet.Leaf(parquet.DoubleType), "float"
+		case []byte:
+			return parquet.Leaf(parquet.ByteArrayType), "bytes"
+		}
+		break
+	}
+	return parquet.String(), "string"
+}
+
+func parquetValue(kind string, v any) (parquet.Value, bool) {
+	switch kind {
+	case "time":
+		if t, ok := v.(time.Time); ok {
+			return parquet.Int64Value(t.UnixMicro()), true
+		}
+	case "bool":
+		if b, ok := v.(bool); ok {
+			return parquet.BooleanValue(b), true
+		}
+	case "int":
+		if f, ok := toFloat64(v); ok {
+			return parquet.Int64Value(int64(f)), true
+		}
+	case "float":
+		if f, ok := toFloat64(v); ok {
+			return parquet.DoubleValue(f), true
+		}
+	case "bytes":
+		if b, ok := v.([]byte); ok {
+			return parquet.ByteArrayValue(b), true
+		}
+	default:
+		if v != nil {
+			return parquet.ByteArrayValue([]byte(formatValue(v))), true
+		}
+	}
+	return parquet.Value{}, false
+}
+
+func writeParquet(f *os.File, table string, fields []string, rows [][]any) error {
+	defer f.Close()
+	group := parquet.Group{}
+	kinds := make([]string, len(fields))
+	for i, field := range fields {
+		node, kind := parquetKind(rows, i)
+		group[field] = parquet.Optional(node)
+		kinds[i] = kind
+	}
+	schema := parquet.NewSchema(table, group)
+	index := make([]int, len(fields))
+	for ci, path := range schema.Columns() {
+		index[slices.Index(fields, path[0])] = ci
+	}
+	pw := parquet.NewWriter(f, schema, parquet.Compression(&parquet.Snappy))
+	for _, row := range rows {
+		prow := make(parquet.Row, len(fields))
+		for i, v := range row {
+			ci := index[i]
+			if pv, ok := parquetValue(kinds[i], v); ok {
+				prow[ci] = pv.Level(0, 1, ci)
+			} else {
+				prow[ci] = parquet.Value{}.Level(0, 0, ci)
+			}
+		}
+		_, err := pw.WriteRows([]parquet.Row{prow})
+		if err != nil {
+			return err
+		}
+	}
+	err := pw.Close()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func countParquet(name string) (int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	pf, err := parquet.OpenFile(f, fi.Size())
+	if err != nil {
+		return 0, err
+	}
+	return pf.NumRows(), nil
+}
+
+// columnValue normalize column values returned by the database drivers
+func columnValue(v any) any {
+	switch n := v.(type) {
+	case nil, bool, int64, float64, string, []byte, time.Time:
+		return n
+	case int:
+		return int64(n)
+	case int32:
+		return int64(n)
+	case int16:
+		return int64(n)
+	case uint8:
+		return int64(n)
+	case float32:
+		return float64(n)
+	case *string:
+		if n == nil {
+			return nil
+		}
+		return *n
+	case map[string]interface{}, []interface{}:
+		b, err := json.Marshal(n)
+		if err != nil {
+			return fmt.Sprint(n)
+		}
+		return string(b)
+	case driver.Valuer:
+		dv, err := n.Value()
+		if err != nil || dv == nil {
+			return nil
+		}
+		// numeric values like Postgres NUMERIC are returned as string
+		if s, ok := dv.(string); ok {
+			if f, err := strconv.ParseFloat(s, 64); err == nil {
+				return f
+			}
+		}
+		return columnValue(dv)
+	}
+	return fmt.Sprint(v)
+}
+
+// formatValue format column values as text
+func formatValue(v any) string {
+	switch n := v.(type) {
+	case nil:
+		return ""
+	case time.Time:
+		return n.Format(time.RFC3339)
+	case []byte:
+		return base64.StdEncoding.EncodeToString(n)
+	case float64:
+		return strconv.FormatFloat(n, 'f', -1, 64)
+	case string:
+		return n
+	}
+	return fmt.Sprint(v)
+}
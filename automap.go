@@ -0,0 +1,175 @@
+/*
+* Copyright 2023-2025 Thorsten A. Knieling
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*    http://www.apache.org/licenses/LICENSE-2.0
+*
+ */
+
+package mqtt2db
+
+import (
+	"bytes"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/tknie/flynn/common"
+	"github.com/tknie/log"
+	"github.com/tknie/services"
+	"gopkg.in/yaml.v3"
+)
+
+var columnNameRegexp = regexp.MustCompile(`[^a-z0-9_]`)
+
+// autoMap extend the mapping of the topic by all payload fields not mapped
+// yet. The store table is created or extended by the new columns.
+func (topic *Topic) autoMap(x map[string]interface{}) {
+	known := make(map[string]bool)
+	for _, m := range topic.Mapping {
+		known[m.Source] = true
+		known[strings.ToLower(m.Destination)] = true
+	}
+	added := make([]MappingEntry, 0)
+	flattenPayload(nil, x, func(path []string, v interface{}) {
+		source := strings.Join(path, "/")
+		destination := columnName(path)
+		if known[source] || known[destination] {
+			return
+		}
+		fdType := inferType(v)
+		if fdType == "" {
+			return
+		}
+		mt, err := parseType(fdType)
+		if err != nil {
+			log.Log.Errorf("Auto mapping type error: %v", err)
+			return
+		}
+		known[destination] = true
+		added = append(added, MappingEntry{Source: source, Destination: destination, Type: fdType, mtype: mt})
+	})
+	if len(added) == 0 {
+		return
+	}
+	// the mapping is read by createColumns on other goroutines holding
+	// the store lock, e.g. creating partitions
+	s := topic.service
+	s.storeLock.Lock()
+	defer s.storeLock.Unlock()
+	mapping := topic.Mapping
+	topic.Mapping = append(slices.Clip(topic.Mapping), added...)
+	for _, m := range added {
+		services.ServerMessage("Auto mapping of topic %s: %s -> %s (%s)", topic.Name, m.Source, m.Destination, m.Type)
+	}
+	if topic.StoreTablename != "" && s.db != nil {
+		err := topic.autoMapTable()
+		if err != nil {
+			services.ServerMessage("Auto mapping table %s failed: %v", topic.StoreTablename, err)
+			topic.Mapping = mapping
+			return
+		}
+	}
+	topic.dumpAutoMap()
+}
+
+// autoMapTable create the store table if not exists or add new columns
+func (topic *Topic) autoMapTable() error {
+	s := topic.service
+	status, err := s.db.CreateTableIfNotExists(topic.StoreTablename, topic.createColumns())
+	if err != nil {
+		return err
+	}
+	if status == common.CreateCreated {
+		return topic.initTable(s.db, s.driver, topic.StoreTablename)
+	}
+	return topic.adaptTable(s.db, s.driver)
+}
+
+// dumpAutoMap write the inferred mapping of the topic as YAML into the
+// auto mapping file. The content can be used to pin the mapping.
+func (topic *Topic) dumpAutoMap() {
+	if topic.AutoMapFile == "" {
+		return
+	}
+	out, err := topic.DumpMapping()
+	if err != nil {
+		log.Log.Errorf("Error marshal auto mapping: %v", err)
+		return
+	}
+	err = os.WriteFile(topic.AutoMapFile, out, 0644)
+	if err != nil {
+		log.Log.Errorf("Error writing auto mapping file %s: %v", topic.AutoMapFile, err)
+	}
+}
+
+// DumpMapping marshal the current mapping of the topic as YAML topic entry
+func (topic *Topic) DumpMapping() ([]byte, error) {
+	pinned := *topic
+	pinned.AutoMap = false
+	pinned.AutoMapFile = ""
+	pinned.Mapping = slices.Clone(topic.Mapping)
+	for i := range pinned.Mapping {
+		// conditions are generated out of ifNegative
+		if pinned.Mapping[i].IfNegative != "" {
+			pinned.Mapping[i].When = nil
+			pinned.Mapping[i].Then = nil
+		}
+	}
+	var buffer bytes.Buffer
+	encoder := yaml.NewEncoder(&buffer)
+	encoder.SetIndent(2)
+	err := encoder.Encode(&struct {
+		Topic []*Topic `yaml:"topic"`
+	}{Topic: []*Topic{&pinned}})
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// flattenPayload call the function for each leaf value of the payload
+// with the path of field names
+func flattenPayload(path []string, x map[string]interface{}, f func(path []string, v interface{})) {
+	keys := make([]string, 0, len(x))
+	for k := range x {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		p := append(slices.Clip(path), k)
+		if sub, ok := x[k].(map[string]interface{}); ok {
+			flattenPayload(p, sub, f)
+			continue
+		}
+		f(p, x[k])
+	}
+}
+
+// columnName create column name out of field path like 'a_b_c'
+func columnName(path []string) string {
+	return columnNameRegexp.ReplaceAllString(strings.ToLower(strings.Join(path, "_")), "_")
+}
+
+// inferType infer mapping type of the observed value. Returns empty string
+// if no type can be inferred.
+func inferType(v interface{}) string {
+	switch t := v.(type) {
+	case bool:
+		return "bool"
+	case float64:
+		return "decimal"
+	case string:
+		if _, err := convertTime(&mappingType{name: "time.Time"}, t); err == nil {
+			return "time.Time"
+		}
+		return "string"
+	case []interface{}:
+		return "json"
+	}
+	return ""
+}
@@ -13,8 +13,10 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/tknie/log"
 	"github.com/tknie/mqtt2db"
@@ -23,15 +25,35 @@ import (
 
 const defaultMaxTries = 10
 
-func init() {
-	services.ServerMessage("Start MQTT2DB application %s (build at %s)", mqtt2db.BuildVersion, mqtt2db.BuildDate)
+var timeLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"}
 
+func init() {
 	log.InitZapLogWithFilename("mqtt2db.log")
 
 }
 
+// parseTime parse time parameter of commands, a duration like '2160h' is
+// the time before now
+func parseTime(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	for _, l := range timeLayouts {
+		if t, err := time.ParseInLocation(l, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time '%s'", s)
+}
+
 func main() {
 	sync := ""
+	format := ""
+	output := ""
+	remove := false
+	dryRun := false
+	closeIfStuck := false
+	resample := time.Duration(0)
 	config := mqtt2db.Config{}
 	username := ""
 	password := ""
@@ -46,15 +68,95 @@ func main() {
 	flag.StringVar(&config.MapFile, "m", config.MapFile, "Define event mapping file")
 	flag.BoolVar(&config.Create, "create", false, "Create new database")
 	flag.StringVar(&sync, "s", "", "Sync to new database")
-	flag.BoolVar(&mqtt2db.CloseIfStuck, "T", false, "Close if in received MQTT loop no messages received")
-	flag.IntVar(&mqtt2db.OutLoopSeconds, "rm", mqtt2db.DefaultLoopSeconds, "Output Received MQTT loop and check cancel")
+	flag.BoolVar(&closeIfStuck, "T", false, "Deprecated, use the /readyz endpoint")
+	flag.StringVar(&format, "format", "", "Format of archive, import or export files")
+	flag.StringVar(&output, "o", "", "Output directory of archive or file of export")
+	flag.BoolVar(&remove, "delete", false, "Delete archived rows")
+	flag.DurationVar(&resample, "resample", 0, "Resample interval of exported rows")
+	flag.BoolVar(&dryRun, "dryrun", false, "Only report changes of commands like retention or import")
+	flag.IntVar(&config.LoopSeconds, "rm", mqtt2db.DefaultLoopSeconds, "Output Received MQTT loop and check cancel")
 
 	flag.Parse()
 
+	if flag.Arg(0) == "export" && (output == "" || output == "-") {
+		// keep standard output clean for the exported data
+		services.OutputMessageMode = false
+	}
+	services.ServerMessage("Start MQTT2DB application %s (build at %s)", mqtt2db.BuildVersion, mqtt2db.BuildDate)
+	if closeIfStuck {
+		services.ServerMessage("Option -T is deprecated and ignored, use the /readyz endpoint")
+	}
+
 	if config.Init() != nil {
 		mqtt2db.InitUrl()
 	}
 
+	switch flag.Arg(0) {
+	case "":
+	case "remap":
+		err := mqtt2db.Remap(flag.Arg(1))
+		if err != nil {
+			services.ServerMessage("Remap of raw payloads failed: %v", err)
+			os.Exit(1)
+		}
+		return
+	case "rollup":
+		err := mqtt2db.BackfillRollup(flag.Arg(1))
+		if err != nil {
+			services.ServerMessage("Backfill of rollup tables failed: %v", err)
+			os.Exit(1)
+		}
+		return
+	case "retention":
+		err := mqtt2db.ApplyRetention(dryRun)
+		if err != nil {
+			services.ServerMessage("Retention failed: %v", err)
+			os.Exit(1)
+		}
+		return
+	case "archive":
+		cutoff, err := parseTime(flag.Arg(2))
+		if err == nil {
+			err = mqtt2db.Archive(flag.Arg(1), cutoff, format, output, remove)
+		}
+		if err != nil {
+			services.ServerMessage("Archive failed: %v", err)
+			os.Exit(1)
+		}
+		return
+	case "import":
+		if !dryRun {
+			config.InitDatabase()
+		}
+		files := []string{}
+		if flag.NArg() > 2 {
+			files = flag.Args()[2:]
+		}
+		err := mqtt2db.Import(flag.Arg(1), format, files, dryRun)
+		if err != nil {
+			services.ServerMessage("Import failed: %v", err)
+			os.Exit(1)
+		}
+		return
+	case "export":
+		from, err := parseTime(flag.Arg(2))
+		to := time.Now()
+		if err == nil && flag.NArg() > 3 {
+			to, err = parseTime(flag.Arg(3))
+		}
+		if err == nil {
+			err = mqtt2db.ExportFile(flag.Arg(1), from, to, format, resample, output)
+		}
+		if err != nil {
+			services.ServerMessage("Export failed: %v", err)
+			os.Exit(1)
+		}
+		return
+	default:
+		services.ServerMessage("Unknown command '%s'", flag.Arg(0))
+		os.Exit(1)
+	}
+
 	if sync != "" {
 		services.ServerMessage("Synchronize databases...")
 		mqtt2db.SyncDatabase(sync)
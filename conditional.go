@@ -0,0 +1,202 @@
+/*
+* Copyright 2023-2025 Thorsten A. Knieling
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*    http://www.apache.org/licenses/LICENSE-2.0
+*
+ */
+
+package mqtt2db
+
+import (
+	"fmt"
+	"math"
+)
+
+var compareType = &mappingType{name: "float64"}
+
+// Condition condition on the mapped value or, if field is defined, on
+// another source field of the message
+type Condition struct {
+	Field string      `yaml:"field,omitempty"`
+	Op    string      `yaml:"op"`
+	Value interface{} `yaml:"value,omitempty"`
+}
+
+// Action target of a conditional mapping. The value is stored into the
+// destination, by default the destination of the mapping, optionally
+// transformed or replaced by a constant value.
+type Action struct {
+	Destination string      `yaml:"destination,omitempty"`
+	Transform   string      `yaml:"transform,omitempty"`
+	Value       interface{} `yaml:"value,omitempty"`
+}
+
+// initConditions check conditions and actions of the mapping entry. The
+// ifNegative rule is converted into a conditional mapping.
+func (e *MappingEntry) initConditions() error {
+	if e.IfNegative != "" {
+		if len(e.When) > 0 {
+			return fmt.Errorf("ifNegative and when both defined for %s", e.Source)
+		}
+		e.When = []Condition{{Op: "lt", Value: 0}}
+		e.Then = []Action{{Destination: e.IfNegative, Transform: "negate"},
+			{Destination: e.Destination, Value: 0}}
+	}
+	if len(e.When) == 0 && (len(e.Then) > 0 || len(e.Else) > 0) {
+		return fmt.Errorf("then/else without when for %s", e.Source)
+	}
+	for _, cond := range e.When {
+		if err := cond.check(); err != nil {
+			return fmt.Errorf("%v for %s", err, e.Source)
+		}
+	}
+	for _, a := range append(append([]Action{}, e.Then...), e.Else...) {
+		switch a.Transform {
+		case "", "negate", "abs":
+		default:
+			return fmt.Errorf("unknown transform '%s' for %s", a.Transform, e.Source)
+		}
+		if a.Value != nil {
+			if _, err := e.mtype.value(yamlValue(a.Value)); err != nil {
+				return fmt.Errorf("invalid value of %s: %v", e.Source, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (cond *Condition) check() error {
+	switch cond.Op {
+	case "lt", "le", "gt", "ge", "eq", "ne":
+		if cond.Value == nil {
+			return fmt.Errorf("condition %s without value", cond.Op)
+		}
+	case "exists", "missing":
+	default:
+		return fmt.Errorf("unknown condition op '%s'", cond.Op)
+	}
+	return nil
+}
+
+// route evaluate the conditions and return the actions to be applied.
+// Returns nil if the value is stored unconditionally into the destination.
+func (e *MappingEntry) route(x map[string]interface{}, f interface{}) []Action {
+	if len(e.When) == 0 {
+		return nil
+	}
+	for _, cond := range e.When {
+		v, ok := f, f != nil
+		if cond.Field != "" {
+			v, ok = sourceValue(x, cond.Field)
+		}
+		if !cond.match(v, ok) {
+			return e.Else
+		}
+	}
+	return e.Then
+}
+
+func (cond *Condition) match(v interface{}, exists bool) bool {
+	switch cond.Op {
+	case "exists":
+		return exists && v != nil
+	case "missing":
+		return !exists || v == nil
+	}
+	if !exists || v == nil {
+		return false
+	}
+	ref := yamlValue(cond.Value)
+	a, aErr := convertFloat64(compareType, numberValue(v))
+	b, bErr := convertFloat64(compareType, ref)
+	if aErr != nil || bErr != nil {
+		as := fmt.Sprintf("%v", v)
+		bs := fmt.Sprintf("%v", ref)
+		switch cond.Op {
+		case "eq":
+			return as == bs
+		case "ne":
+			return as != bs
+		}
+		return false
+	}
+	x, y := a.(float64), b.(float64)
+	switch cond.Op {
+	case "lt":
+		return x < y
+	case "le":
+		return x <= y
+	case "gt":
+		return x > y
+	case "ge":
+		return x >= y
+	case "eq":
+		return x == y
+	case "ne":
+		return x != y
+	}
+	return false
+}
+
+// apply calculate the destination value of the action. Returns false if no
+// value is available.
+func (a *Action) apply(e *MappingEntry, f interface{}) (string, interface{}, bool) {
+	destination := a.Destination
+	if destination == "" {
+		destination = e.Destination
+	}
+	if a.Value != nil {
+		v, err := e.mtype.value(yamlValue(a.Value))
+		return destination, v, err == nil
+	}
+	if f == nil {
+		return destination, nil, false
+	}
+	switch a.Transform {
+	case "negate":
+		switch v := f.(type) {
+		case int32:
+			return destination, -v, true
+		case int64:
+			return destination, -v, true
+		case float64:
+			return destination, -v, true
+		}
+	case "abs":
+		switch v := f.(type) {
+		case int32:
+			return destination, int32(math.Abs(float64(v))), true
+		case int64:
+			return destination, int64(math.Abs(float64(v))), true
+		case float64:
+			return destination, math.Abs(v), true
+		}
+	}
+	return destination, f, true
+}
+
+// yamlValue normalize YAML scalar value to the types of a JSON payload
+func yamlValue(v interface{}) interface{} {
+	switch n := v.(type) {
+	case int:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case uint64:
+		return float64(n)
+	}
+	return v
+}
+
+// numberValue normalize converted values for numeric comparison
+func numberValue(v interface{}) interface{} {
+	switch n := v.(type) {
+	case int32:
+		return float64(n)
+	}
+	return v
+}
@@ -12,9 +12,13 @@
 package mqtt2db
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/tknie/log"
 	"github.com/tknie/services"
 )
 
@@ -25,12 +29,13 @@ var BuildDate string
 var BuildVersion string
 
 type Config struct {
-	Qos        int
-	Clientid   string
-	MapFile    string
-	Create     bool
-	TrackInput int
-	MaxTries   int
+	Qos         int
+	Clientid    string
+	MapFile     string
+	Create      bool
+	TrackInput  int
+	MaxTries    int
+	LoopSeconds int
 }
 
 func (config *Config) Init() error {
@@ -42,15 +47,44 @@ func (config *Config) Init() error {
 	return nil
 }
 
-func (config *Config) Start() {
-	config.InitDatabase()
-	defer Close()
-	defer services.ServerMessage("MQTT2DB stopped")
+// service default service configured by the command line parameters
+func (config *Config) service() *Service {
+	s := defaultService
+	s.config.Qos = config.Qos
+	s.config.ClientID = config.Clientid
+	s.config.Create = config.Create
+	s.config.MaxTries = config.MaxTries
+	s.config.LoopSeconds = config.LoopSeconds
+	return s
+}
 
-	config.ConnectMQTT()
+// InitDatabase initialize the database of the default service
+func (config *Config) InitDatabase() {
+	err := config.service().initDatabase()
+	if err != nil {
+		services.ServerMessage("Database initialization failed: %v", err)
+		log.Log.Fatalf("Database initialization failed: %v", err)
+	}
+}
+
+// Start start the default service and wait for the termination signal
+func (config *Config) Start() {
+	s := config.service()
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	err := s.Start(ctx)
+	if err != nil {
+		services.ServerMessage("Start failed: %v", err)
+		log.Log.Fatalf("Start failed: %v", err)
+	}
+	<-ctx.Done()
+	fmt.Println("signal received, exiting")
+	s.Stop()
+	services.ServerMessage("MQTT2DB stopped")
 }
 
 func (config *Config) LoadDefaults(username, password string) {
+	c := defaultService.config.Mapping
 	if username != "" {
 		c.Mqtt.Username = username
 	} else if c.Mqtt.Username == "" {
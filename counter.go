@@ -0,0 +1,189 @@
+/*
+* Copyright 2023-2025 Thorsten A. Knieling
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*    http://www.apache.org/licenses/LICENSE-2.0
+*
+ */
+
+package mqtt2db
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tknie/flynn/common"
+	"github.com/tknie/log"
+	"github.com/tknie/services"
+)
+
+const counterStateInterval = time.Minute
+
+// Counter cumulative counter like a meter reading. For each value the
+// delta to the last value and the rate per hour are derived.
+type Counter struct {
+	Delta    string  `yaml:"delta,omitempty"`
+	Rate     string  `yaml:"rate,omitempty"`
+	Rollover float64 `yaml:"rollover,omitempty"`
+}
+
+type counterState struct {
+	Value float64   `json:"value"`
+	Time  time.Time `json:"time"`
+}
+
+// counterStore last counter values of all topics of a service. Transient
+// stores, e.g. used by the import, are not loaded from or saved into the
+// state file.
+type counterStore struct {
+	lock      sync.Mutex
+	states    map[string]*counterState
+	loaded    bool
+	saved     time.Time
+	transient bool
+}
+
+func (e *MappingEntry) deltaColumn() string {
+	if e.Counter.Delta != "" {
+		return e.Counter.Delta
+	}
+	return e.Destination + "_delta"
+}
+
+func (e *MappingEntry) rateColumn() string {
+	if e.Counter.Rate != "" {
+		return e.Counter.Rate
+	}
+	return e.Destination + "_rate"
+}
+
+// rateUnit unit of the rate column, the rate is calculated per hour
+func (e *MappingEntry) rateUnit() string {
+	if e.Unit == "" {
+		return ""
+	}
+	return e.Unit + "/h"
+}
+
+// counterColumns create delta and rate columns of all counter entries
+func (topic *Topic) counterColumns() []*common.Column {
+	columns := make([]*common.Column, 0)
+	for _, m := range topic.Mapping {
+		if m.Counter == nil {
+			continue
+		}
+		for _, name := range []string{m.deltaColumn(), m.rateColumn()} {
+			columns = append(columns, &common.Column{Name: name, DataType: common.Decimal,
+				Length: defaultDecimalLength, Digits: defaultDecimalDigits})
+		}
+	}
+	return columns
+}
+
+// applyCounters derive delta and rate of all counter entries out of the
+// states of the store. The state is kept per received MQTT topic name, so
+// each device of a wildcard subscription has its own counter. Meter resets
+// and rollovers are detected if the value decreases.
+func (topic *Topic) applyCounters(store *counterStore, name string, e map[string]interface{}, received time.Time) {
+	t := received
+	if topic.Timestamp != nil {
+		if ts, ok := e[topic.Timestamp.Destination].(time.Time); ok {
+			t = ts
+		}
+	}
+	s := topic.service
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if !store.transient {
+		s.loadCounterState()
+	}
+	for _, m := range topic.Mapping {
+		if m.Counter == nil {
+			continue
+		}
+		v, err := convertFloat64(compareType, numberValue(e[m.Destination]))
+		if err != nil || e[m.Destination] == nil {
+			continue
+		}
+		value := v.(float64)
+		key := name + "|" + m.Destination
+		last, ok := store.states[key]
+		store.states[key] = &counterState{Value: value, Time: t}
+		if !ok {
+			log.Log.Debugf("First counter value %s=%v", key, value)
+			continue
+		}
+		delta := value - last.Value
+		if delta < 0 {
+			if m.Counter.Rollover > 0 {
+				delta = m.Counter.Rollover - last.Value + value
+				services.ServerMessage("Counter %s rollover detected: %v -> %v", key, last.Value, value)
+			} else {
+				delta = value
+				services.ServerMessage("Counter %s reset detected: %v -> %v", key, last.Value, value)
+			}
+		}
+		e[m.deltaColumn()] = delta
+		if hours := t.Sub(last.Time).Hours(); hours > 0 {
+			e[m.rateColumn()] = delta / hours
+		}
+	}
+	if !store.transient && time.Since(store.saved) > counterStateInterval {
+		s.saveCounterState()
+	}
+}
+
+func (s *Service) loadCounterState() {
+	stateFile := s.config.Mapping.StateFile
+	if s.counters.loaded || stateFile == "" {
+		return
+	}
+	s.counters.loaded = true
+	b, err := os.ReadFile(stateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Log.Errorf("Error reading state file %s: %v", stateFile, err)
+		}
+		return
+	}
+	err = json.Unmarshal(b, &s.counters.states)
+	if err != nil {
+		log.Log.Errorf("Error parsing state file %s: %v", stateFile, err)
+		return
+	}
+	services.ServerMessage("Loaded %d counter states from %s", len(s.counters.states), stateFile)
+}
+
+func (s *Service) saveCounterState() {
+	stateFile := s.config.Mapping.StateFile
+	if stateFile == "" {
+		return
+	}
+	s.counters.saved = time.Now()
+	b, err := json.Marshal(s.counters.states)
+	if err != nil {
+		log.Log.Errorf("Error marshal counter state: %v", err)
+		return
+	}
+	tmp := stateFile + ".tmp"
+	err = os.WriteFile(tmp, b, 0644)
+	if err == nil {
+		err = os.Rename(tmp, stateFile)
+	}
+	if err != nil {
+		log.Log.Errorf("Error writing state file %s: %v", stateFile, err)
+	}
+}
+
+// SaveCounterState write the last counter values into the state file, used
+// on shutdown
+func (s *Service) SaveCounterState() {
+	s.counters.lock.Lock()
+	defer s.counters.lock.Unlock()
+	s.saveCounterState()
+}
@@ -12,13 +12,18 @@
 package mqtt2db
 
 import (
+	"bytes"
+	"database/sql/driver"
 	"fmt"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/tknie/flynn"
 	"github.com/tknie/flynn/common"
+	"github.com/tknie/flynn/dbsql"
 	"github.com/tknie/log"
 	"github.com/tknie/services"
 )
@@ -45,8 +50,6 @@ var SQLbatches = []string{
 	`CREATE INDEX home_inserted_on_idx_desc ON public.home USING btree (inserted_on DESC);`,
 	`ALTER TABLE public.home ADD id serial4 NOT NULL;`}
 
-var dbid common.RegDbID
-
 type Home struct {
 	ID          uint64
 	Time        time.Time
@@ -60,34 +63,52 @@ func (d *Home) String() string {
 	return fmt.Sprintf("[%d:%v/%v]", d.ID, d.Time.UTC().Format(layout), d.Inserted_on.UTC().Format(layout))
 }
 
-// InitDatabase initialize database by
+// initDatabase initialize database by
 //   - creating storage table
 //   - create index for inserted_on
 //   - create function for updating inserted_on the current
 //     timestamp
 //   - add id serial
-func (config *Config) InitDatabase() {
-	create := config.Create
-	tries := config.MaxTries
-	dbRef, password := getUrl()
-
-	id, err := flynn.Handler(dbRef, password)
-	if err != nil {
-		services.ServerMessage("Register error log: %v", err)
-		log.Log.Fatalf("Register error log: %v", err)
+func (s *Service) initDatabase() error {
+	create := s.config.Create
+	tries := s.config.MaxTries
+	if tries <= 0 {
+		tries = 1
+	}
+	id := s.db
+	if id == nil && s.config.Mapping.Database.Url == "" {
+		services.ServerMessage("No database defined, entries are only written into the sinks")
+		return nil
+	}
+	if id == nil {
+		var release func()
+		var err error
+		id, release, err = s.handler()
+		if err != nil {
+			return fmt.Errorf("register error: %v", err)
+		}
+		s.release = append(s.release, release)
 	}
 	var status common.CreateStatus
+	var err error
 	count := 0
 	for count < tries {
 		count++
 		log.Log.Debugf("Try count=%d", count)
 
 		if create {
-			for _, topic := range c.Topic {
+			for _, topic := range s.config.Mapping.Topic {
+				if !topic.usesDatabase() {
+					continue
+				}
 				log.Log.Debugf("Create table for topic '%s'", topic.Name)
 				columns := topic.createColumns()
 				// create table if not exists
-				status, err = id.CreateTableIfNotExists(topic.StoreTablename, columns)
+				if topic.nativePartition() {
+					status, err = topic.createPartitionedTable(id)
+				} else {
+					status, err = id.CreateTableIfNotExists(topic.StoreTablename, columns)
+				}
 				if err != nil {
 					if count < 10 {
 						services.ServerMessage("Wait because of creation err %T: %v", status, err)
@@ -95,28 +116,27 @@ func (config *Config) InitDatabase() {
 						services.ServerMessage("Skip counter increased to %d", count)
 						continue
 					} else {
-						services.ServerMessage("Database storage creating failed: %v %T", err, status)
-						log.Log.Fatalf("Database storage creating failed: %v %T", err, status)
+						return fmt.Errorf("database storage creating failed: %v %T", err, status)
 					}
 				}
 				log.Log.Debugf("Received status=%v", status)
-				// if database is created, then call batch commands
-				if status == common.CreateCreated {
-					for i, batch := range SQLbatches {
-						b := strings.Replace(batch, "public.home", "public."+topic.StoreTablename, -1)
-						b = strings.Replace(b, "home_inserted_on_idx", topic.StoreTablename+"_inserted_on_idx", -1)
-
-						err = id.Batch(b)
-						if err != nil {
-							fmt.Println("Database batch failed: ", b)
-							fmt.Println("Database orig batch: ", batch)
-							log.Log.Fatalf("Database batch(%03d/%s) for topic '%s' failed: %v", i, topic.StoreTablename, topic.Name, err)
-						}
+				// if database is created, then call batch commands, existing
+				// tables get the columns added to the mapping
+				switch status {
+				case common.CreateCreated:
+					err = topic.initTable(id, s.driver, topic.StoreTablename)
+					if err != nil {
+						return fmt.Errorf("database batch for topic '%s' failed: %v", topic.Name, err)
+					}
+				case common.CreateExists:
+					err = topic.adaptTable(id, s.driver)
+					if err != nil {
+						return fmt.Errorf("adapting table of topic '%s' failed: %v", topic.Name, err)
 					}
 				}
 			}
 		}
-		dbid = id
+		s.db = id
 
 		// final ping checks if database is online
 		err = id.Ping()
@@ -126,40 +146,131 @@ func (config *Config) InitDatabase() {
 			services.ServerMessage("Skip counter increased to %d", count)
 		} else {
 			services.ServerMessage("Database pinging successfullly done")
+			for _, topic := range s.config.Mapping.Topic {
+				if topic.Partition == nil {
+					continue
+				}
+				err = topic.ensurePartitions(id, time.Now())
+				if err != nil {
+					return fmt.Errorf("creating partitions failed: %v", err)
+				}
+			}
 			services.ServerMessage("Database initiated")
-			return
+			return nil
 		}
 		log.Log.Debugf("End error=%v", err)
 	}
-
+	return fmt.Errorf("database not reachable: %v", err)
 }
 
-// close close and unregister flynn identifier
-func Close() {
-	defer dbid.FreeHandler()
-}
+// initTable call batch commands on the new created store table
+func (topic *Topic) initTable(id DatabaseClient, driver common.ReferenceType, table string) error {
+	if _, ok := id.(*sqliteDB); ok {
+		return sqliteInit(id, table)
+	}
+	for i, batch := range SQLbatches {
+		b := strings.Replace(batch, "public.home", "public."+table, -1)
+		b = strings.Replace(b, "home_inserted_on_idx", table+"_inserted_on_idx", -1)
 
-func (topic *Topic) storeEvent(e map[string]interface{}) {
-	if topic.StoreTablename == "" {
-		return
+		err := id.Batch(b)
+		if err != nil {
+			fmt.Println("Database batch failed: ", b)
+			fmt.Println("Database orig batch: ", batch)
+			return fmt.Errorf("batch(%03d/%s): %v", i, table, err)
+		}
 	}
-	list := [][]any{{e}}
-	keys := make([]string, 0, len(e))
-	for k := range e {
-		keys = append(keys, k)
+	if driver == common.PostgresType {
+		for _, col := range topic.jsonbColumns() {
+			err := id.Batch(jsonbBatch(table, col))
+			if err != nil {
+				return fmt.Errorf("JSONB column %s: %v", col, err)
+			}
+		}
 	}
-	insert := &common.Entries{Fields: keys,
-		Update: keys,
-		Values: list}
-	_, err := dbid.Insert(topic.StoreTablename, insert)
+	return nil
+}
+
+func jsonbBatch(tableName, column string) string {
+	return fmt.Sprintf("ALTER TABLE public.%s ALTER COLUMN %s TYPE jsonb USING %s::jsonb;",
+		tableName, column, column)
+}
+
+// adaptTable add all mapped columns of the topic missing in the store table
+func (topic *Topic) adaptTable(id DatabaseClient, driver common.ReferenceType) error {
+	current, err := id.GetTableColumn(topic.StoreTablename)
 	if err != nil {
-		log.Log.Fatal("Error inserting record: ", err)
+		return err
+	}
+	jsonbColumns := topic.jsonbColumns()
+	for _, col := range topic.createColumns().([]*common.Column) {
+		if slices.ContainsFunc(current, func(s string) bool { return strings.EqualFold(s, col.Name) }) {
+			continue
+		}
+		var buffer bytes.Buffer
+		if _, ok := id.(*sqliteDB); ok {
+			sqliteColumn(&buffer, col)
+		} else {
+			dbsql.CreateTableByColumn(&buffer, driver == common.PostgresType, col)
+		}
+		services.ServerMessage("Add column %s to table %s", buffer.String(), topic.StoreTablename)
+		err = id.Batch("ALTER TABLE " + topic.StoreTablename + " ADD " + buffer.String())
+		if err != nil {
+			return err
+		}
+		if driver == common.PostgresType && slices.Contains(jsonbColumns, col.Name) {
+			err = id.Batch(jsonbBatch(topic.StoreTablename, col.Name))
+			if err != nil {
+				return err
+			}
+		}
 	}
+	return nil
+}
 
+// Close stop the default service and release its database handlers
+func Close() {
+	defaultService.Stop()
+}
+
+func (topic *Topic) storeEvent(e map[string]interface{}) {
+	topic.store([]map[string]interface{}{e})
+}
+
+// toFloat64 convert numeric database values
+func toFloat64(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	case []byte:
+		f, err := strconv.ParseFloat(string(n), 64)
+		return f, err == nil
+	case driver.Valuer:
+		dv, err := n.Value()
+		if err != nil || dv == nil {
+			return 0, false
+		}
+		return toFloat64(dv)
+	}
+	return 0, false
 }
 
 func SyncDatabase(syncSource string) {
-	dbRef, password := getUrl()
+	dbRef, password, err := defaultService.reference()
+	if err != nil {
+		services.ServerMessage("Database URL incorrect: %v", err)
+		log.Log.Fatalf("Database URL incorrect: %v", err)
+	}
 
 	services.ServerMessage("Synchronize of Home data")
 	sid, err := flynn.Handler(dbRef, password)
@@ -0,0 +1,294 @@
+/*
+* Copyright 2023-2025 Thorsten A. Knieling
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*    http://www.apache.org/licenses/LICENSE-2.0
+*
+ */
+
+package mqtt2db
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tknie/flynn/common"
+	"github.com/tknie/services"
+)
+
+// export formats
+const (
+	ExportCSV    = "csv"
+	ExportJSONL  = "jsonl"
+	ExportInflux = "influx"
+)
+
+type exportWriter struct {
+	format      string
+	measurement string
+	fields      []string
+	out         *bufio.Writer
+	csv         *csv.Writer
+	count       uint64
+}
+
+type resampleBucket struct {
+	start  time.Time
+	sums   []float64
+	counts []int
+	last   []any
+}
+
+// Export write all rows of the topic stored between from and to as CSV,
+// JSON-lines or Influx line protocol. The columns are defined by the topic
+// mapping. With resample one row per interval is written containing the
+// average of numeric columns and the last value of other columns.
+func (s *Service) Export(name string, from, to time.Time, format string, resample time.Duration, w io.Writer) error {
+	topic := s.findTopic(name)
+	if topic == nil {
+		return fmt.Errorf("topic '%s' not found", name)
+	}
+	switch format {
+	case "":
+		format = ExportCSV
+	case ExportCSV, ExportJSONL, ExportInflux:
+	default:
+		return fmt.Errorf("unknown export format '%s'", format)
+	}
+	column := topic.storeTimeColumn()
+	fields := []string{column}
+	for _, col := range topic.createColumns().([]*common.Column) {
+		if !strings.EqualFold(col.Name, column) && col.Name != topic.RawColumn {
+			fields = append(fields, col.Name)
+		}
+	}
+
+	id, release, err := s.handler()
+	if err != nil {
+		return err
+	}
+	defer release()
+	tables, err := topic.queryTables(id)
+	if err != nil {
+		return err
+	}
+
+	ew := &exportWriter{format: format, measurement: topic.StoreTablename, fields: fields,
+		out: bufio.NewWriter(w)}
+	if format == ExportCSV {
+		ew.csv = csv.NewWriter(ew.out)
+		err = ew.csv.Write(fields)
+		if err != nil {
+			return err
+		}
+	}
+	var bucket *resampleBucket
+	for _, table := range tables {
+		query := &common.Query{
+			TableName: table,
+			Fields:    fields,
+			Search: fmt.Sprintf("%s >= '%s' AND %s < '%s'", column, sqlTime(id, from, sqlTimeLayout),
+				column, sqlTime(id, to, sqlTimeLayout)),
+			Order: []string{column + ":ASC"},
+		}
+		_, err = id.Query(query, func(search *common.Query, result *common.Result) error {
+			row := make([]any, len(result.Rows))
+			for i, v := range result.Rows {
+				row[i] = columnValue(v)
+			}
+			t, ok := row[0].(time.Time)
+			if !ok {
+				return fmt.Errorf("column %s is not a time stamp: %T", column, row[0])
+			}
+			if resample == 0 {
+				return ew.write(t, row)
+			}
+			start := t.Truncate(resample)
+			if bucket != nil && !bucket.start.Equal(start) {
+				if err := ew.write(bucket.start, bucket.row()); err != nil {
+					return err
+				}
+				bucket = nil
+			}
+			if bucket == nil {
+				bucket = &resampleBucket{start: start, sums: make([]float64, len(row)),
+					counts: make([]int, len(row)), last: make([]any, len(row))}
+			}
+			bucket.add(row)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if bucket != nil {
+		err = ew.write(bucket.start, bucket.row())
+		if err != nil {
+			return err
+		}
+	}
+	if ew.csv != nil {
+		ew.csv.Flush()
+		if err = ew.csv.Error(); err != nil {
+			return err
+		}
+	}
+	err = ew.out.Flush()
+	if err != nil {
+		return err
+	}
+	services.ServerMessage("Exported %d rows of topic %s", ew.count, topic.Name)
+	return nil
+}
+
+func (b *resampleBucket) add(row []any) {
+	for i, v := range row {
+		switch v.(type) {
+		case int64, float64:
+			f, _ := toFloat64(v)
+			b.sums[i] += f
+			b.counts[i]++
+		case nil:
+		default:
+			b.last[i] = v
+		}
+	}
+}
+
+func (b *resampleBucket) row() []any {
+	row := make([]any, len(b.last))
+	for i := range row {
+		if b.counts[i] > 0 {
+			row[i] = b.sums[i] / float64(b.counts[i])
+		} else {
+			row[i] = b.last[i]
+		}
+	}
+	row[0] = b.start
+	return row
+}
+
+func (ew *exportWriter) write(t time.Time, row []any) error {
+	row[0] = t
+	ew.count++
+	switch ew.format {
+	case ExportCSV:
+		record := make([]string, len(row))
+		for i, v := range row {
+			record[i] = formatValue(v)
+		}
+		return ew.csv.Write(record)
+	case ExportJSONL:
+		e := make(map[string]any, len(row))
+		for i, v := range row {
+			if v != nil {
+				e[ew.fields[i]] = v
+			}
+		}
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		ew.out.Write(b)
+		return ew.out.WriteByte('\n')
+	default:
+		fields := make(map[string]any, len(row))
+		for i, v := range row[1:] {
+			fields[ew.fields[i+1]] = v
+		}
+		line := lineProtocol(ew.measurement, nil, fields, t)
+		if line == "" {
+			ew.count--
+			return nil
+		}
+		_, err := ew.out.WriteString(line + "\n")
+		return err
+	}
+}
+
+var lineEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+var stringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// lineProtocol format one point in the InfluxDB line protocol. Returns an
+// empty string if no field value is available.
+func lineProtocol(measurement string, tags map[string]string, fields map[string]any, t time.Time) string {
+	var sb strings.Builder
+	sb.WriteString(strings.NewReplacer(",", `\,`, " ", `\ `).Replace(measurement))
+	for _, k := range sortedKeys(tags) {
+		if tags[k] == "" {
+			continue
+		}
+		sb.WriteString("," + lineEscaper.Replace(k) + "=" + lineEscaper.Replace(tags[k]))
+	}
+	n := 0
+	for _, k := range sortedKeys(fields) {
+		var v string
+		switch f := fields[k].(type) {
+		case nil, time.Time:
+			continue
+		case bool:
+			v = strconv.FormatBool(f)
+		case int64:
+			v = strconv.FormatInt(f, 10) + "i"
+		case int32:
+			v = strconv.FormatInt(int64(f), 10) + "i"
+		case float64:
+			v = strconv.FormatFloat(f, 'f', -1, 64)
+		default:
+			v = `"` + stringEscaper.Replace(formatValue(f)) + `"`
+		}
+		if n == 0 {
+			sb.WriteByte(' ')
+		} else {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(lineEscaper.Replace(k) + "=" + v)
+		n++
+	}
+	if n == 0 {
+		return ""
+	}
+	sb.WriteString(" " + strconv.FormatInt(t.UnixNano(), 10))
+	return sb.String()
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// ExportFile export into the file or to stdout if no file name is given
+func (s *Service) ExportFile(name string, from, to time.Time, format string, resample time.Duration, file string) error {
+	if file == "" || file == "-" {
+		return s.Export(name, from, to, format, resample, os.Stdout)
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	err = s.Export(name, from, to, format, resample, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// ExportFile export the topic of the default service
+func ExportFile(name string, from, to time.Time, format string, resample time.Duration, file string) error {
+	return defaultService.ExportFile(name, from, to, format, resample, file)
+}
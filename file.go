@@ -0,0 +1,279 @@
+/*
+* Copyright 2023-2025 Thorsten A. Knieling
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*    http://www.apache.org/licenses/LICENSE-2.0
+*
+ */
+
+package mqtt2db
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/tknie/flynn/common"
+	"github.com/tknie/log"
+)
+
+const (
+	defaultFileMaxSize = 100 * 1024 * 1024
+	defaultFileRotate  = 24 * time.Hour
+	fileTimeLayout     = "20060102-150405"
+)
+
+// File sink writing the entries of each topic into files below the
+// directory. A new file is started if the file exceeds maxSize bytes
+// (uncompressed) or is older than rotate. With raw the raw payload column
+// of the topic is written too.
+type File struct {
+	Dir      string        `yaml:"dir"`
+	Format   string        `yaml:"format,omitempty"`
+	MaxSize  int64         `yaml:"maxSize,omitempty"`
+	Rotate   time.Duration `yaml:"rotate,omitempty"`
+	Compress bool          `yaml:"compress,omitempty"`
+	Raw      bool          `yaml:"raw,omitempty"`
+}
+
+type fileSink struct {
+	config    *File
+	format    string
+	maxSize   int64
+	rotate    time.Duration
+	lock      sync.Mutex
+	files     map[string]*rotatedFile
+	lastError error
+}
+
+// rotatedFile current file of a topic
+type rotatedFile struct {
+	name   string
+	file   *os.File
+	gz     *gzip.Writer
+	out    *bufio.Writer
+	csv    *csv.Writer
+	fields []string
+	size   int64
+	opened time.Time
+}
+
+func newFileSink(config *File) (Sink, error) {
+	if config.Dir == "" {
+		return nil, fmt.Errorf("file sink directory missing")
+	}
+	sink := &fileSink{config: config, format: config.Format, maxSize: config.MaxSize,
+		rotate: config.Rotate, files: make(map[string]*rotatedFile)}
+	switch sink.format {
+	case "":
+		sink.format = ExportJSONL
+	case ExportJSONL, ExportCSV:
+	default:
+		return nil, fmt.Errorf("unknown file format '%s'", sink.format)
+	}
+	if sink.maxSize <= 0 {
+		sink.maxSize = defaultFileMaxSize
+	}
+	if sink.rotate <= 0 {
+		sink.rotate = defaultFileRotate
+	}
+	return sink, os.MkdirAll(config.Dir, 0755)
+}
+
+// fileFields columns written into CSV files
+func (topic *Topic) fileFields(raw bool) []string {
+	fields := make([]string, 0)
+	for _, col := range topic.createColumns().([]*common.Column) {
+		if raw || col.Name != topic.RawColumn {
+			fields = append(fields, col.Name)
+		}
+	}
+	return fields
+}
+
+func (sink *fileSink) Write(topic *Topic, entries []map[string]interface{}) error {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	err := sink.write(topic, entries)
+	sink.lastError = err
+	return err
+}
+
+func (sink *fileSink) write(topic *Topic, entries []map[string]interface{}) error {
+	base := topic.outputName()
+	for _, e := range entries {
+		rf := sink.files[base]
+		if rf != nil && (rf.size >= sink.maxSize || time.Since(rf.opened) >= sink.rotate) {
+			delete(sink.files, base)
+			if err := rf.close(); err != nil {
+				return err
+			}
+			rf = nil
+		}
+		if rf == nil {
+			var err error
+			rf, err = sink.open(topic, base)
+			if err != nil {
+				return err
+			}
+			sink.files[base] = rf
+		}
+		if err := rf.write(sink.format, topic.RawColumn, sink.config.Raw, e); err != nil {
+			return fmt.Errorf("file %s: %v", rf.name, err)
+		}
+	}
+	return nil
+}
+
+// open create a new file of the topic named by the current time
+func (sink *fileSink) open(topic *Topic, base string) (*rotatedFile, error) {
+	dir := filepath.Join(sink.config.Dir, base)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	ext := "." + sink.format
+	if sink.config.Compress {
+		ext += ".gz"
+	}
+	name := filepath.Join(dir, base+"_"+now.Format(fileTimeLayout)+ext)
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	for i := 1; os.IsExist(err); i++ {
+		name = filepath.Join(dir, fmt.Sprintf("%s_%s_%d%s", base, now.Format(fileTimeLayout), i, ext))
+		f, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Log.Debugf("Open sink file %s", name)
+	rf := &rotatedFile{name: name, file: f, opened: now}
+	var w io.Writer = f
+	if sink.config.Compress {
+		rf.gz = gzip.NewWriter(f)
+		w = rf.gz
+	}
+	rf.out = bufio.NewWriter(w)
+	if sink.format == ExportCSV {
+		rf.csv = csv.NewWriter(rf)
+		rf.fields = topic.fileFields(sink.config.Raw)
+		err = rf.csv.Write(rf.fields)
+		if err != nil {
+			rf.close()
+			return nil, err
+		}
+	}
+	return rf, nil
+}
+
+// Write count the uncompressed bytes written into the file
+func (rf *rotatedFile) Write(p []byte) (int, error) {
+	n, err := rf.out.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatedFile) write(format, rawColumn string, raw bool, e map[string]interface{}) error {
+	if format == ExportCSV {
+		record := make([]string, len(rf.fields))
+		for i, field := range rf.fields {
+			if v, ok := e[field]; ok {
+				record[i] = formatValue(columnValue(v))
+			}
+		}
+		return rf.csv.Write(record)
+	}
+	line := make(map[string]any, len(e))
+	for k, v := range e {
+		if v != nil && (raw || k != rawColumn) {
+			line[k] = columnValue(v)
+		}
+	}
+	b, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	_, err = rf.Write(append(b, '\n'))
+	return err
+}
+
+// flush write the buffered data into the file, a partially written
+// compressed file stays readable
+func (rf *rotatedFile) flush() error {
+	if rf.csv != nil {
+		rf.csv.Flush()
+		if err := rf.csv.Error(); err != nil {
+			return err
+		}
+	}
+	err := rf.out.Flush()
+	if err == nil && rf.gz != nil {
+		err = rf.gz.Flush()
+	}
+	return err
+}
+
+func (rf *rotatedFile) close() error {
+	err := rf.flush()
+	if rf.gz != nil {
+		if cerr := rf.gz.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if cerr := rf.file.Close(); err == nil {
+		err = cerr
+	}
+	log.Log.Debugf("Closed sink file %s with %d bytes", rf.name, rf.size)
+	return err
+}
+
+// Flush write the buffered data of all files and close files older than
+// the rotation time
+func (sink *fileSink) Flush() error {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	var err error
+	for base, rf := range sink.files {
+		var ferr error
+		if time.Since(rf.opened) >= sink.rotate {
+			delete(sink.files, base)
+			ferr = rf.close()
+		} else {
+			ferr = rf.flush()
+		}
+		if ferr != nil {
+			err = fmt.Errorf("file %s: %v", rf.name, ferr)
+		}
+	}
+	sink.lastError = err
+	return err
+}
+
+func (sink *fileSink) Close() error {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	var err error
+	for _, rf := range sink.files {
+		if cerr := rf.close(); cerr != nil {
+			err = fmt.Errorf("file %s: %v", rf.name, cerr)
+		}
+	}
+	sink.files = make(map[string]*rotatedFile)
+	return err
+}
+
+func (sink *fileSink) Health() error {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	return sink.lastError
+}
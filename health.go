@@ -0,0 +1,66 @@
+/*
+* Copyright 2023-2025 Thorsten A. Knieling
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*    http://www.apache.org/licenses/LICENSE-2.0
+*
+ */
+
+package mqtt2db
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// healthHandler process is alive
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// readyHandler ready if MQTT is connected and subscribed, the database is
+// reachable and no topic is silent longer than its maximum silence
+func (s *Service) readyHandler(w http.ResponseWriter, r *http.Request) {
+	problems := s.readinessProblems(time.Now())
+	if len(problems) == 0 {
+		fmt.Fprintln(w, "ok")
+		return
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+	for _, p := range problems {
+		fmt.Fprintln(w, p)
+	}
+}
+
+func (s *Service) readinessProblems(now time.Time) []string {
+	problems := make([]string, 0)
+	if !s.metrics.mqttConnected.Load() {
+		problems = append(problems, "MQTT not connected")
+	}
+	if !s.metrics.mqttSubscribed.Load() {
+		problems = append(problems, "MQTT subscriptions not acknowledged")
+	}
+	if !s.metrics.databaseUp.Load() {
+		problems = append(problems, "database not reachable")
+	}
+	problems = append(problems, s.sinkProblems()...)
+	for _, topic := range s.config.Mapping.Topic {
+		if silence := topic.silence(now); topic.MaxSilence > 0 && silence > topic.MaxSilence {
+			problems = append(problems, fmt.Sprintf("topic %s silent for %v", topic.Name, silence.Round(time.Second)))
+		}
+	}
+	return problems
+}
+
+// silence duration since the last message of the topic or since start
+func (topic *Topic) silence(now time.Time) time.Duration {
+	last := topic.service.startTime
+	if l := topic.metrics().lastMessage.Load(); l > 0 {
+		last = time.Unix(0, l)
+	}
+	return now.Sub(last)
+}
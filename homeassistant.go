@@ -0,0 +1,146 @@
+/*
+* Copyright 2023-2025 Thorsten A. Knieling
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*    http://www.apache.org/licenses/LICENSE-2.0
+*
+ */
+
+package mqtt2db
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+const defaultDiscoveryPrefix = "homeassistant"
+
+var discoveryIDRegexp = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// device classes derived from the unit if not defined in the mapping
+var unitDeviceClass = map[string]string{
+	"W": "power", "kW": "power", "Wh": "energy", "kWh": "energy", "MWh": "energy",
+	"V": "voltage", "mV": "voltage", "A": "current", "mA": "current",
+	"VA": "apparent_power", "var": "reactive_power", "Hz": "frequency",
+	"°C": "temperature", "°F": "temperature", "K": "temperature",
+	"Pa": "pressure", "hPa": "pressure", "mbar": "pressure", "bar": "pressure",
+	"lx": "illuminance", "dBm": "signal_strength", "m³": "gas",
+}
+
+// Discovery Home Assistant MQTT discovery of the republished entries. A
+// sensor is announced for each mapped destination reading the republished
+// topic.
+type Discovery struct {
+	Prefix string `yaml:"prefix,omitempty"`
+	Device string `yaml:"device,omitempty"`
+}
+
+type discoveryDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	SwVersion    string   `json:"sw_version,omitempty"`
+}
+
+type discoveryConfig struct {
+	Name          string          `json:"name"`
+	UniqueID      string          `json:"unique_id"`
+	StateTopic    string          `json:"state_topic"`
+	ValueTemplate string          `json:"value_template"`
+	Unit          string          `json:"unit_of_measurement,omitempty"`
+	DeviceClass   string          `json:"device_class,omitempty"`
+	StateClass    string          `json:"state_class,omitempty"`
+	Device        discoveryDevice `json:"device"`
+	component     string
+}
+
+// discoveryConfigs Home Assistant configurations of all mapped destinations
+// of the topic published to the state topic
+func (topic *Topic) discoveryConfigs(d *Discovery, stateTopic string) []*discoveryConfig {
+	name := topic.outputName()
+	device := discoveryDevice{Identifiers: []string{"mqtt2db_" + name}, Name: d.Device,
+		Manufacturer: "mqtt2db", SwVersion: BuildVersion}
+	if device.Name == "" {
+		device.Name = name
+	}
+	configs := make([]*discoveryConfig, 0)
+	added := make(map[string]bool)
+	add := func(key string, m *MappingEntry, unit, stateClass string, derived bool) {
+		if added[key] {
+			return
+		}
+		added[key] = true
+		dc := &discoveryConfig{Name: key, UniqueID: discoveryIDRegexp.ReplaceAllString("mqtt2db_"+name+"_"+key, "_"),
+			StateTopic: stateTopic, ValueTemplate: "{{ value_json['" + key + "'] }}", Unit: unit,
+			StateClass: stateClass, Device: device, component: "sensor"}
+		switch {
+		case m.mtype.name == "bool":
+			dc.component = "binary_sensor"
+			dc.ValueTemplate = "{{ 'ON' if value_json['" + key + "'] else 'OFF' }}"
+			dc.DeviceClass = m.DeviceClass
+		case m.mtype.name == "time.Time":
+			dc.DeviceClass = "timestamp"
+		case !derived:
+			dc.DeviceClass = m.DeviceClass
+			if dc.DeviceClass == "" {
+				dc.DeviceClass = unitDeviceClass[unit]
+			}
+			if m.StateClass != "" {
+				dc.StateClass = m.StateClass
+			} else if m.Counter != nil || dc.DeviceClass == "energy" || dc.DeviceClass == "gas" {
+				dc.StateClass = "total_increasing"
+			}
+		}
+		configs = append(configs, dc)
+	}
+	for i := range topic.Mapping {
+		m := &topic.Mapping[i]
+		numeric := false
+		switch m.mtype.name {
+		case "int32", "int64", "float64", "decimal":
+			numeric = true
+		case "json", "jsonb", "bytes":
+			continue
+		}
+		stateClass := ""
+		if numeric {
+			stateClass = "measurement"
+		}
+		for _, destination := range topic.columnDestinations(m) {
+			switch {
+			case topic.Aggregate == nil:
+				add(destination, m, m.Unit, stateClass, false)
+			case numeric:
+				add(destination+"_avg", m, m.Unit, stateClass, false)
+			case m.mtype.name != "time.Time":
+				add(destination, m, m.Unit, stateClass, false)
+			}
+		}
+		if m.Counter != nil {
+			suffix := ""
+			if topic.Aggregate != nil {
+				suffix = "_avg"
+			}
+			add(m.deltaColumn()+suffix, m, m.Unit, "measurement", true)
+			add(m.rateColumn()+suffix, m, m.rateUnit(), "measurement", true)
+		}
+	}
+	return configs
+}
+
+// discoveryTopic topic the configuration is published to
+func (d *Discovery) discoveryTopic(dc *discoveryConfig) string {
+	prefix := strings.TrimSuffix(d.Prefix, "/")
+	if prefix == "" {
+		prefix = defaultDiscoveryPrefix
+	}
+	return prefix + "/" + dc.component + "/" + dc.UniqueID + "/config"
+}
+
+func (dc *discoveryConfig) payload() ([]byte, error) {
+	return json.Marshal(dc)
+}
@@ -0,0 +1,357 @@
+/*
+* Copyright 2023-2025 Thorsten A. Knieling
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*    http://www.apache.org/licenses/LICENSE-2.0
+*
+ */
+
+package mqtt2db
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tknie/flynn/common"
+	"github.com/tknie/log"
+	"github.com/tknie/services"
+)
+
+// import file formats
+const (
+	ImportCSV     = "csv"
+	ImportJSONL   = "jsonl"
+	ImportPayload = "payload"
+)
+
+const maxImportLine = 1024 * 1024
+
+const importBatchSize = 100
+
+type importRecord struct {
+	received time.Time
+	entry    map[string]interface{}
+}
+
+type importStats struct {
+	read       uint64
+	ignored    uint64
+	rejected   uint64
+	duplicates uint64
+	stored     uint64
+}
+
+// Import read historical records out of CSV, JSON-lines or saved MQTT
+// payload files, map them with the topic mapping and store them like
+// received messages. Records with a time stamp already stored are skipped.
+// With dryRun nothing is stored.
+func (s *Service) Import(name, format string, files []string, dryRun bool) error {
+	topic := s.findTopic(name)
+	if topic == nil {
+		return fmt.Errorf("topic '%s' not found", name)
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no import file given")
+	}
+	// counters of imported records must not use or change the live state
+	counters := &counterStore{states: make(map[string]*counterState), transient: true}
+
+	stats := &importStats{}
+	records := make([]*importRecord, 0)
+	for _, file := range files {
+		services.ServerMessage("Import file %s", file)
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		var r io.Reader = f
+		if strings.HasSuffix(file, ".gz") {
+			gz, err := gzip.NewReader(f)
+			if err != nil {
+				f.Close()
+				return err
+			}
+			r = gz
+		}
+		add := func(x map[string]interface{}, raw []byte, received time.Time) {
+			r := topic.importRecord(counters, x, raw, received, stats)
+			if r != nil {
+				records = append(records, r)
+			}
+		}
+		switch importFormat(format, file) {
+		case ImportCSV:
+			err = readImportCSV(r, add)
+		case ImportJSONL:
+			err = readImportLines(r, false, topic, add)
+		case ImportPayload:
+			err = readImportLines(r, true, topic, add)
+		default:
+			err = fmt.Errorf("unknown import format '%s'", format)
+		}
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("import of %s: %v", file, err)
+		}
+	}
+
+	existing, err := topic.existingTimes(records)
+	if err != nil {
+		return err
+	}
+	column := topic.timeColumn()
+	batch := make([]map[string]interface{}, 0, importBatchSize)
+	for _, r := range records {
+		if existing != nil {
+			if t, ok := r.entry[column].(time.Time); ok {
+				key := t.UTC().Format(time.RFC3339)
+				if existing[key] {
+					stats.duplicates++
+					continue
+				}
+				existing[key] = true
+			}
+		}
+		stats.stored++
+		if dryRun {
+			continue
+		}
+		if topic.Aggregate != nil {
+			topic.aggregate(topic.Name, r.entry, r.received)
+		} else {
+			batch = append(batch, r.entry)
+			if len(batch) == importBatchSize {
+				topic.store(batch)
+				batch = make([]map[string]interface{}, 0, importBatchSize)
+			}
+		}
+		if stats.stored%10000 == 0 {
+			services.ServerMessage("Imported %d records", stats.stored)
+		}
+	}
+	if !dryRun {
+		if len(batch) > 0 {
+			topic.store(batch)
+		}
+		if topic.Aggregate != nil {
+			topic.flushAggregates(time.Now(), true)
+		}
+		s.flushSinks()
+		if topic.Rollup != nil {
+			if err = s.openHandler(&s.rollupDB); err != nil {
+				return err
+			}
+			topic.flushRollup()
+		}
+	}
+	verb := "stored"
+	if dryRun {
+		verb = "would be stored"
+	}
+	services.ServerMessage("Import of %d records: %d %s, %d duplicates, %d ignored, %d rejected",
+		stats.read, stats.stored, verb, stats.duplicates, stats.ignored, stats.rejected)
+	return nil
+}
+
+// Import import into the topic of the default service
+func Import(name, format string, files []string, dryRun bool) error {
+	return defaultService.Import(name, format, files, dryRun)
+}
+
+func importFormat(format, file string) string {
+	if format != "" {
+		return format
+	}
+	switch strings.ToLower(filepath.Ext(strings.TrimSuffix(file, ".gz"))) {
+	case ".csv":
+		return ImportCSV
+	case ".jsonl", ".json":
+		return ImportJSONL
+	}
+	return ImportPayload
+}
+
+// importRecord map one imported record, the counters are derived out of
+// the import store. Without receive time the time stamp of the mapped
+// entry is used.
+func (topic *Topic) importRecord(counters *counterStore, x map[string]interface{}, raw []byte, received time.Time, stats *importStats) *importRecord {
+	stats.read++
+	if received.IsZero() {
+		received = time.Now()
+		if column := topic.timeColumn(); column != "" {
+			if e, err := topic.createEntry(x, received); err == nil {
+				if t, ok := e[column].(time.Time); ok {
+					received = t
+				}
+			}
+		}
+	}
+	if !topic.accept(x, received) {
+		stats.ignored++
+		return nil
+	}
+	em, err := topic.parseMessage(counters, topic.Name, x, received)
+	if err != nil {
+		log.Log.Infof("Import record %d rejected: %v", stats.read, err)
+		stats.rejected++
+		return nil
+	}
+	if topic.RawColumn != "" {
+		if raw == nil {
+			raw, _ = json.Marshal(x)
+		}
+		em[topic.RawColumn] = string(raw)
+	}
+	if stats.read%10000 == 0 {
+		services.ServerMessage("Read %d records", stats.read)
+	}
+	return &importRecord{received: received, entry: em}
+}
+
+// readImportCSV read CSV records with header. Header names like 'eHZ/E_in'
+// are converted into sub documents to be referenced by the mapping sources.
+func readImportCSV(r io.Reader, add func(map[string]interface{}, []byte, time.Time)) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return err
+	}
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		x := make(map[string]interface{})
+		for i, v := range record {
+			if i >= len(header) || v == "" {
+				continue
+			}
+			setSourceValue(x, header[i], v)
+		}
+		add(x, nil, time.Time{})
+	}
+}
+
+func setSourceValue(x map[string]interface{}, source string, v interface{}) {
+	path := strings.Split(source, "/")
+	for _, p := range path[:len(path)-1] {
+		sub, ok := x[p].(map[string]interface{})
+		if !ok {
+			sub = make(map[string]interface{})
+			x[p] = sub
+		}
+		x = sub
+	}
+	x[path[len(path)-1]] = v
+}
+
+// readImportLines read JSON payloads line by line. Saved MQTT payloads may
+// be prefixed by the receive time and the topic like written by
+// 'mosquitto_sub -v -F "%I %t %p"'.
+func readImportLines(r io.Reader, prefixed bool, topic *Topic, add func(map[string]interface{}, []byte, time.Time)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxImportLine)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		received := time.Time{}
+		if prefixed {
+			idx := strings.IndexByte(text, '{')
+			if idx < 0 {
+				log.Log.Infof("Skip line %d without JSON payload", line)
+				continue
+			}
+			match := true
+			for _, p := range strings.Fields(text[:idx]) {
+				if t, err := time.Parse(time.RFC3339, p); err == nil {
+					received = t
+				} else {
+					match = topicFilterMatch(topic.Name, p)
+				}
+			}
+			if !match {
+				continue
+			}
+			text = text[idx:]
+		}
+		x := make(map[string]interface{})
+		err := json.Unmarshal([]byte(text), &x)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		add(x, []byte(text), received)
+	}
+	return scanner.Err()
+}
+
+// existingTimes time stamps already stored in the range of the imported
+// records, used to skip duplicates. Returns nil if the topic has no time
+// column to check.
+func (topic *Topic) existingTimes(records []*importRecord) (map[string]bool, error) {
+	column := topic.timeColumn()
+	if column == "" || topic.Aggregate != nil {
+		services.ServerMessage("No time stamp column for duplicate check of topic %s", topic.Name)
+		return nil, nil
+	}
+	var first, last time.Time
+	for _, r := range records {
+		if t, ok := r.entry[column].(time.Time); ok {
+			if first.IsZero() || t.Before(first) {
+				first = t
+			}
+			if t.After(last) {
+				last = t
+			}
+		}
+	}
+	existing := make(map[string]bool)
+	if first.IsZero() {
+		return existing, nil
+	}
+	id, release, err := topic.service.handler()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	tables, err := topic.queryTables(id)
+	if err != nil {
+		return nil, err
+	}
+	for _, table := range tables {
+		query := &common.Query{
+			TableName: table,
+			Fields:    []string{column},
+			Search: fmt.Sprintf("%s >= '%s' AND %s <= '%s'", column, sqlTime(id, first, sqlTimeLayout),
+				column, sqlTime(id, last.Add(time.Second), sqlTimeLayout)),
+		}
+		_, err = id.Query(query, func(search *common.Query, result *common.Result) error {
+			if t, ok := result.Rows[0].(time.Time); ok {
+				existing[t.UTC().Format(time.RFC3339)] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return existing, nil
+}
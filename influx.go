@@ -0,0 +1,237 @@
+/*
+* Copyright 2023-2025 Thorsten A. Knieling
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*    http://www.apache.org/licenses/LICENSE-2.0
+*
+ */
+
+package mqtt2db
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tknie/log"
+	"github.com/tknie/services"
+)
+
+const (
+	defaultInfluxBatchSize = 1000
+	defaultInfluxRetries   = 3
+	defaultInfluxTimeout   = 10 * time.Second
+	influxBufferBatches    = 10
+)
+
+// influxRetryDelay delay before the first retry, doubled on each retry
+var influxRetryDelay = time.Second
+
+// Influx sink writing the entries in the InfluxDB line protocol over HTTP.
+// The URL is the complete write endpoint like
+// 'http://influx:8086/api/v2/write?org=home&bucket=mqtt' or
+// 'http://victoria:8428/write'. Mapping entries with tag are written as
+// tags, all other values as fields.
+type Influx struct {
+	URL         string        `yaml:"url"`
+	Token       string        `yaml:"token,omitempty"`
+	Measurement string        `yaml:"measurement,omitempty"`
+	BatchSize   int           `yaml:"batchSize,omitempty"`
+	Retries     int           `yaml:"retries,omitempty"`
+	Timeout     time.Duration `yaml:"timeout,omitempty"`
+}
+
+type influxSink struct {
+	config    *Influx
+	client    *http.Client
+	token     string
+	batchSize int
+	retries   int
+	lock      sync.Mutex
+	sendLock  sync.Mutex
+	lines     []string
+	lastError error
+	flush     chan struct{}
+	done      chan struct{}
+}
+
+func newInfluxSink(config *Influx) (Sink, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("influx URL missing")
+	}
+	sink := &influxSink{config: config, token: os.ExpandEnv(config.Token),
+		batchSize: config.BatchSize, retries: config.Retries}
+	if sink.batchSize <= 0 {
+		sink.batchSize = defaultInfluxBatchSize
+	}
+	if sink.retries <= 0 {
+		sink.retries = defaultInfluxRetries
+	}
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = defaultInfluxTimeout
+	}
+	sink.client = &http.Client{Timeout: timeout}
+	sink.flush = make(chan struct{}, 1)
+	sink.done = make(chan struct{})
+	go sink.loopFlush()
+	return sink, nil
+}
+
+// loopFlush send full batches in the background, so retries do not block
+// receiving messages
+func (sink *influxSink) loopFlush() {
+	for {
+		select {
+		case <-sink.done:
+			return
+		case <-sink.flush:
+			if err := sink.Flush(); err != nil {
+				log.Log.Errorf("Error flushing influx sink: %v", err)
+			}
+		}
+	}
+}
+
+// influxLine convert the entry into one line of the line protocol
+func (topic *Topic) influxLine(measurement string, e map[string]interface{}) string {
+	if measurement == "" {
+		measurement = topic.outputName()
+	}
+	tags := make(map[string]string)
+	fields := make(map[string]any, len(e))
+	for k, v := range e {
+		if k != topic.RawColumn {
+			fields[k] = v
+		}
+	}
+	for _, m := range topic.Mapping {
+		if !m.Tag {
+			continue
+		}
+		if v, ok := fields[m.Destination]; ok {
+			if v != nil {
+				tags[m.Destination] = formatValue(v)
+			}
+			delete(fields, m.Destination)
+		}
+	}
+	if topic.Aggregate != nil && topic.Aggregate.DeviceColumn != "" {
+		if v, ok := fields[topic.Aggregate.DeviceColumn]; ok {
+			tags[topic.Aggregate.DeviceColumn] = formatValue(v)
+			delete(fields, topic.Aggregate.DeviceColumn)
+		}
+	}
+	t, ok := e[topic.timeColumn()].(time.Time)
+	if !ok {
+		t = time.Now()
+	}
+	return lineProtocol(measurement, tags, fields, t)
+}
+
+func (sink *influxSink) Write(topic *Topic, entries []map[string]interface{}) error {
+	sink.lock.Lock()
+	for _, e := range entries {
+		if line := topic.influxLine(sink.config.Measurement, e); line != "" {
+			sink.lines = append(sink.lines, line)
+		}
+	}
+	full := len(sink.lines) >= sink.batchSize
+	sink.lock.Unlock()
+	if full {
+		select {
+		case sink.flush <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Flush send the buffered lines in batches. Batches failed after all
+// retries are kept for the next flush up to a limit, the oldest lines are
+// dropped if the limit is exceeded. Batches refused by the server are
+// dropped.
+func (sink *influxSink) Flush() error {
+	sink.sendLock.Lock()
+	defer sink.sendLock.Unlock()
+	for {
+		sink.lock.Lock()
+		n := min(len(sink.lines), sink.batchSize)
+		batch := sink.lines[:n]
+		sink.lock.Unlock()
+		if n == 0 {
+			return nil
+		}
+		retry, err := sink.send(batch)
+		sink.lock.Lock()
+		sink.lastError = err
+		if err == nil || !retry {
+			sink.lines = sink.lines[n:]
+		} else if limit := influxBufferBatches * sink.batchSize; len(sink.lines) > limit {
+			dropped := len(sink.lines) - limit
+			sink.lines = sink.lines[dropped:]
+			services.ServerMessage("Influx sink dropped %d lines", dropped)
+		}
+		sink.lock.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// send post the lines, server errors and rate limits are retried. Returns
+// true if a failed batch can be retried later.
+func (sink *influxSink) send(lines []string) (bool, error) {
+	body := []byte(strings.Join(lines, "\n") + "\n")
+	for try := 0; ; try++ {
+		retry, err := sink.post(body)
+		if err == nil || !retry || try >= sink.retries {
+			return retry, err
+		}
+		log.Log.Debugf("Influx write try %d failed: %v", try+1, err)
+		time.Sleep(influxRetryDelay << try)
+	}
+}
+
+func (sink *influxSink) post(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, sink.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if sink.token != "" {
+		req.Header.Set("Authorization", "Token "+sink.token)
+	}
+	resp, err := sink.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("influx write status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return false, fmt.Errorf("influx write status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+}
+
+func (sink *influxSink) Close() error {
+	close(sink.done)
+	return sink.Flush()
+}
+
+func (sink *influxSink) Health() error {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	return sink.lastError
+}
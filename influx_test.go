@@ -0,0 +1,175 @@
+/*
+* Copyright 2023-2025 Thorsten A. Knieling
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*    http://www.apache.org/licenses/LICENSE-2.0
+*
+ */
+
+package mqtt2db
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// influxStub HTTP write endpoint answering with the given status codes in
+// order, the last status code is repeated
+type influxStub struct {
+	lock     sync.Mutex
+	statuses []int
+	bodies   []string
+	auth     []string
+}
+
+func (stub *influxStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	stub.lock.Lock()
+	defer stub.lock.Unlock()
+	stub.bodies = append(stub.bodies, string(body))
+	stub.auth = append(stub.auth, r.Header.Get("Authorization"))
+	status := http.StatusNoContent
+	if len(stub.statuses) > 0 {
+		status = stub.statuses[0]
+		if len(stub.statuses) > 1 {
+			stub.statuses = stub.statuses[1:]
+		}
+	}
+	w.WriteHeader(status)
+}
+
+func (stub *influxStub) requests() []string {
+	stub.lock.Lock()
+	defer stub.lock.Unlock()
+	return append([]string{}, stub.bodies...)
+}
+
+func newInfluxTest(t *testing.T, config *Influx, statuses ...int) (*influxSink, *influxStub) {
+	delay := influxRetryDelay
+	influxRetryDelay = time.Millisecond
+	stub := &influxStub{statuses: statuses}
+	server := httptest.NewServer(stub)
+	config.URL = server.URL
+	sink, err := newInfluxSink(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		close(sink.(*influxSink).done)
+		server.Close()
+		influxRetryDelay = delay
+	})
+	return sink.(*influxSink), stub
+}
+
+func influxTopic() *Topic {
+	return &Topic{Name: "tele/+/SENSOR", StoreTablename: "home", RawColumn: "payload",
+		Timestamp: &Timestamp{Destination: "Time"},
+		Mapping: Mapping{{Source: "Room", Destination: "Room", Tag: true},
+			{Source: "Power", Destination: "Power"}, {Source: "Temp", Destination: "Temp"}}}
+}
+
+func influxEntry(power int64) map[string]interface{} {
+	return map[string]interface{}{"Time": time.Unix(1700000000, 5), "Room": "living room",
+		"Power": power, "Temp": 21.5, "payload": `{"Power":1}`}
+}
+
+func TestInfluxLine(t *testing.T) {
+	topic := influxTopic()
+	line := topic.influxLine("", influxEntry(372))
+	expected := `home,Room=living\ room Power=372i,Temp=21.5 1700000000000000005`
+	if line != expected {
+		t.Errorf("line %q, expected %q", line, expected)
+	}
+	line = topic.influxLine("meter", influxEntry(1))
+	if !strings.HasPrefix(line, "meter,") {
+		t.Errorf("measurement not used: %q", line)
+	}
+	topic.StoreTablename = ""
+	line = topic.influxLine("", influxEntry(1))
+	if !strings.HasPrefix(line, "tele___SENSOR,") {
+		t.Errorf("topic name not used as measurement: %q", line)
+	}
+}
+
+func TestInfluxBatch(t *testing.T) {
+	sink, stub := newInfluxTest(t, &Influx{Token: "secret", BatchSize: 2})
+	topic := influxTopic()
+	err := sink.Write(topic, []map[string]interface{}{influxEntry(1), influxEntry(2), influxEntry(3)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sink.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := stub.requests()
+	if len(requests) != 2 {
+		t.Fatalf("expected 2 batches, got %d: %q", len(requests), requests)
+	}
+	if n := strings.Count(requests[0], "\n"); n != 2 {
+		t.Errorf("first batch has %d lines", n)
+	}
+	if !strings.Contains(requests[1], "Power=3i") {
+		t.Errorf("second batch %q", requests[1])
+	}
+	if stub.auth[0] != "Token secret" {
+		t.Errorf("authorization %q", stub.auth[0])
+	}
+}
+
+func TestInfluxRetry(t *testing.T) {
+	for _, status := range []int{http.StatusInternalServerError, http.StatusTooManyRequests} {
+		sink, stub := newInfluxTest(t, &Influx{Retries: 2}, status, http.StatusNoContent)
+		sink.Write(influxTopic(), []map[string]interface{}{influxEntry(1)})
+		err := sink.Flush()
+		if err != nil {
+			t.Fatalf("status %d: %v", status, err)
+		}
+		if n := len(stub.requests()); n != 2 {
+			t.Errorf("status %d: expected 2 requests, got %d", status, n)
+		}
+		if len(sink.lines) != 0 || sink.Health() != nil {
+			t.Errorf("status %d: batch not sent", status)
+		}
+	}
+}
+
+func TestInfluxKeepFailed(t *testing.T) {
+	sink, stub := newInfluxTest(t, &Influx{Retries: 1}, http.StatusServiceUnavailable)
+	sink.Write(influxTopic(), []map[string]interface{}{influxEntry(1)})
+	if err := sink.Flush(); err == nil {
+		t.Fatal("expected error")
+	}
+	if n := len(stub.requests()); n != 2 {
+		t.Errorf("expected 2 requests, got %d", n)
+	}
+	if len(sink.lines) != 1 || sink.Health() == nil {
+		t.Errorf("failed batch not kept: %d lines", len(sink.lines))
+	}
+}
+
+func TestInfluxDropRefused(t *testing.T) {
+	sink, stub := newInfluxTest(t, &Influx{}, http.StatusBadRequest)
+	sink.Write(influxTopic(), []map[string]interface{}{influxEntry(1)})
+	if err := sink.Flush(); err == nil {
+		t.Fatal("expected error")
+	}
+	if n := len(stub.requests()); n != 1 {
+		t.Errorf("refused batch retried: %d requests", n)
+	}
+	if len(sink.lines) != 0 {
+		t.Errorf("refused batch not dropped: %d lines", len(sink.lines))
+	}
+	if sink.Health() == nil {
+		t.Error("expected health error")
+	}
+}
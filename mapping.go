@@ -12,11 +12,14 @@
 package mqtt2db
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
-	"reflect"
-	"runtime/debug"
-	"strconv"
+	"regexp"
+	"slices"
 	"strings"
 	"time"
 
@@ -39,58 +42,238 @@ type Mqtt struct {
 	LoopIntervalSeconds int    `yaml:"loopIntervalSeconds"`
 }
 
-type Mapping []struct {
-	Source      string `yaml:"source"`
-	Destination string `yaml:"destination"`
-	Type        string `yaml:"type"`
-	IfNegative  string `yaml:"ifNegative,omitempty"`
+// MappingEntry mapping of a source field of the MQTT message to the
+// destination column
+type MappingEntry struct {
+	Source      string      `yaml:"source"`
+	Destination string      `yaml:"destination"`
+	Type        string      `yaml:"type"`
+	IfNegative  string      `yaml:"ifNegative,omitempty"`
+	Required    bool        `yaml:"required,omitempty"`
+	Min         *float64    `yaml:"min,omitempty"`
+	Max         *float64    `yaml:"max,omitempty"`
+	Regex       string      `yaml:"regex,omitempty"`
+	Enum        []string    `yaml:"enum,omitempty"`
+	When        []Condition `yaml:"when,omitempty"`
+	Then        []Action    `yaml:"then,omitempty"`
+	Else        []Action    `yaml:"else,omitempty"`
+	Counter     *Counter    `yaml:"counter,omitempty"`
+	Tag         bool        `yaml:"tag,omitempty"`
+	Unit        string      `yaml:"unit,omitempty"`
+	DeviceClass string      `yaml:"deviceClass,omitempty"`
+	StateClass  string      `yaml:"stateClass,omitempty"`
+	mtype       *mappingType
+	regex       *regexp.Regexp
 }
 
+type Mapping []MappingEntry
+
 type Topic struct {
-	Name           string  `yaml:"name"`
-	StoreTablename string  `yaml:"storeTablename"`
-	Mapping        Mapping `yaml:"mapping"`
+	Name           string        `yaml:"name"`
+	StoreTablename string        `yaml:"storeTablename"`
+	Mapping        Mapping       `yaml:"mapping"`
+	Timestamp      *Timestamp    `yaml:"timestamp,omitempty"`
+	RawColumn      string        `yaml:"rawColumn,omitempty"`
+	AutoMap        bool          `yaml:"autoMap,omitempty"`
+	AutoMapFile    string        `yaml:"autoMapFile,omitempty"`
+	Reject         *Reject       `yaml:"reject,omitempty"`
+	Filter         []Condition   `yaml:"filter,omitempty"`
+	Sample         *Sample       `yaml:"sample,omitempty"`
+	Aggregate      *Aggregate    `yaml:"aggregate,omitempty"`
+	Rollup         *Rollup       `yaml:"rollup,omitempty"`
+	Retention      *Retention    `yaml:"retention,omitempty"`
+	Partition      *Partition    `yaml:"partition,omitempty"`
+	MaxSilence     time.Duration `yaml:"maxSilence,omitempty"`
+	Alert          *Alert        `yaml:"alert,omitempty"`
+	Sinks          []string      `yaml:"sinks,omitempty"`
+	sample         *sampleState
+	aggregator     *aggregator
+	rollup         *rollupState
+	partition      *partitionState
+	service        *Service
 }
 
-func (topic *Topic) createColumns() any {
-	columns := make([]*common.Column, 0)
-	length := uint16(0)
-	for _, m := range topic.Mapping {
+// initMapping check and resolve mapping types of the topic
+func (topic *Topic) initMapping() error {
+	for i := range topic.Mapping {
+		m := &topic.Mapping[i]
 		if m.Destination == "" {
-			log.Log.Fatalf("Mapping for topic '%s' has empty destination field %s", topic.Name, m.Source)
-			continue
+			return fmt.Errorf("mapping for topic '%s' has empty destination field %s", topic.Name, m.Source)
+		}
+		mt, err := parseType(m.Type)
+		if err != nil {
+			return fmt.Errorf("%v for topic '%s'", err, topic.Name)
+		}
+		m.mtype = mt
+		err = m.initValidation()
+		if err == nil {
+			err = m.initConditions()
 		}
-		var dataType common.DataType
-		switch m.Type {
-		case "int64":
-			dataType = common.Number
-			length = 8
-		case "float64":
-			dataType = common.Decimal
-			length = 10
-		case "string":
-			dataType = common.Alpha
-			length = 255
-		case "time.Time":
-			dataType = common.CurrentTimestamp
+		if err == nil && m.Counter != nil {
+			switch m.mtype.name {
+			case "int32", "int64", "float64", "decimal":
+			default:
+				err = fmt.Errorf("counter not valid for type '%s' of %s", m.Type, m.Source)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%v for topic '%s'", err, topic.Name)
+		}
+	}
+	if topic.Timestamp != nil {
+		switch topic.Timestamp.OnSkew {
+		case "", skewCorrect, skewReject:
 		default:
-			log.Log.Fatalf("Unknown data type '%s' for topic '%s'", m.Type, topic.Name)
+			return fmt.Errorf("unknown onSkew '%s' for topic '%s'", topic.Timestamp.OnSkew, topic.Name)
+		}
+	}
+	if topic.Aggregate != nil {
+		if err := topic.Aggregate.check(topic.Name, topic.RawColumn); err != nil {
+			return err
+		}
+		topic.aggregator = &aggregator{windows: make(map[string]*aggregateWindow)}
+	}
+	if topic.Rollup != nil {
+		if err := topic.checkRollup(); err != nil {
+			return err
+		}
+	}
+	if topic.Partition != nil {
+		if err := topic.checkPartition(); err != nil {
+			return err
+		}
+	}
+	if topic.Retention != nil {
+		if err := topic.checkRetention(); err != nil {
+			return err
+		}
+	}
+	return topic.initFilter()
+}
+
+// timeColumn time stamp column of the store table if known by the mapping
+func (topic *Topic) timeColumn() string {
+	switch {
+	case topic.Aggregate != nil:
+		return windowStartColumn
+	case topic.Timestamp != nil:
+		return topic.Timestamp.Destination
+	}
+	return ""
+}
+
+// storeTimeColumn time stamp column of the store table, the 'inserted_on'
+// column created by mqtt2db if the mapping has none
+func (topic *Topic) storeTimeColumn() string {
+	if tc := topic.timeColumn(); tc != "" {
+		return tc
+	}
+	return insertedOnColumn
+}
+
+func (topic *Topic) createColumns() any {
+	if topic.Aggregate != nil {
+		return topic.aggregateColumns()
+	}
+	columns := make([]*common.Column, 0)
+	added := make(map[string]bool)
+	for _, m := range topic.Mapping {
+		for _, destination := range topic.columnDestinations(&m) {
+			if added[strings.ToLower(destination)] {
+				continue
+			}
+			added[strings.ToLower(destination)] = true
+			log.Log.Debugf("Add column %s with type %s length %d", destination, m.Type, m.mtype.length)
+			columns = append(columns, m.mtype.column(destination))
 		}
-		log.Log.Debugf("Add column %s with type %s length %d", m.Destination, m.Type, length)
-		columns = append(columns, &common.Column{Name: m.Destination, DataType: dataType, Length: length})
+	}
+	if topic.Timestamp != nil && topic.Timestamp.Destination != "" && !topic.hasDestination(topic.Timestamp.Destination) {
+		log.Log.Debugf("Add time stamp column %s", topic.Timestamp.Destination)
+		columns = append(columns, &common.Column{Name: topic.Timestamp.Destination, DataType: common.CurrentTimestamp})
+	}
+	columns = append(columns, topic.counterColumns()...)
+	if topic.RawColumn != "" {
+		log.Log.Debugf("Add raw payload column %s", topic.RawColumn)
+		columns = append(columns, &common.Column{Name: topic.RawColumn, DataType: common.Text})
 	}
 	// columns = append(columns, &common.Column{Name: "inserted_on", DataType: common.CurrentTimestamp})
 	return columns
 }
 
-type Mqtt2db struct {
-	Database Database `yaml:"database"`
-	Mqtt     Mqtt     `yaml:"mqtt"`
-	Topic    []*Topic `yaml:"topic"`
+// destinations list of all mapped destination columns in mapping order
+func (topic *Topic) destinations() []string {
+	destinations := make([]string, 0, len(topic.Mapping))
+	for _, m := range topic.Mapping {
+		for _, destination := range m.destinations() {
+			if !slices.Contains(destinations, destination) {
+				destinations = append(destinations, destination)
+			}
+		}
+	}
+	return destinations
 }
 
-var c = &Mqtt2db{}
+// destinations list of the destination and all conditional destinations
+// of the mapping entry
+func (e *MappingEntry) destinations() []string {
+	destinations := []string{e.Destination}
+	for _, a := range append(append([]Action{}, e.Then...), e.Else...) {
+		if a.Destination != "" && !slices.Contains(destinations, a.Destination) {
+			destinations = append(destinations, a.Destination)
+		}
+	}
+	return destinations
+}
+
+// columnDestinations destinations of the mapping entry whose column type
+// is defined by the entry. A conditional destination mapped by an own
+// entry gets the type of that entry, independent of the mapping order.
+func (topic *Topic) columnDestinations(m *MappingEntry) []string {
+	destinations := make([]string, 0)
+	for _, destination := range m.destinations() {
+		if strings.EqualFold(destination, m.Destination) || !topic.hasDestination(destination) {
+			destinations = append(destinations, destination)
+		}
+	}
+	return destinations
+}
+
+// jsonbColumns list of all columns stored as JSONB in Postgres
+func (topic *Topic) jsonbColumns() []string {
+	columns := make([]string, 0)
+	for _, m := range topic.Mapping {
+		if m.mtype.jsonb {
+			columns = append(columns, topic.columnDestinations(&m)...)
+		}
+	}
+	if topic.RawColumn != "" {
+		columns = append(columns, topic.RawColumn)
+	}
+	return columns
+}
 
+func (topic *Topic) hasDestination(destination string) bool {
+	for _, m := range topic.Mapping {
+		if strings.EqualFold(m.Destination, destination) {
+			return true
+		}
+	}
+	return false
+}
+
+type Mqtt2db struct {
+	Database  Database      `yaml:"database"`
+	Mqtt      Mqtt          `yaml:"mqtt"`
+	Reject    *Reject       `yaml:"reject,omitempty"`
+	StateFile string        `yaml:"stateFile,omitempty"`
+	HTTP      *HTTP         `yaml:"http,omitempty"`
+	Alert     *Alert        `yaml:"alert,omitempty"`
+	Sinks     []*SinkConfig `yaml:"sinks,omitempty"`
+	Topic     []*Topic      `yaml:"topic"`
+}
+
+// InitMapping parse the mapping file into the default service and reload
+// it on changes
 func InitMapping(mapFile string) {
 	services.InitWatcher(mapFile, mapFile, watchConfig)
 	parseMapping(mapFile)
@@ -102,46 +285,48 @@ func watchConfig(s string, a any) error {
 	return nil
 }
 
-func parseMapping(mapFile string) {
+// LoadMapping read the mapping configuration file
+func LoadMapping(mapFile string) (*Mqtt2db, error) {
 	log.Log.Debugf("Parsing mapping config file %s", mapFile)
 	yamlFile, err := os.ReadFile(mapFile)
 	if err != nil {
-		log.Log.Errorf("yamlFile.Get err   #%v ", err)
+		return nil, err
 	}
-	err = yaml.Unmarshal(yamlFile, c)
+	// unknown keys are reported, but do not stop existing configurations
+	strict := yaml.NewDecoder(bytes.NewReader(yamlFile))
+	strict.KnownFields(true)
+	if err = strict.Decode(&Mqtt2db{}); err != nil && err != io.EOF {
+		services.ServerMessage("Warning: configuration file %s contains unknown entries: %v", mapFile, err)
+	}
+	m := &Mqtt2db{}
+	err = yaml.Unmarshal(yamlFile, m)
 	if err != nil {
-		services.ServerErrorMessage("Configuration parsing error: %v", err)
-		log.Log.Fatalf("Unmarshal: %v", err)
+		return nil, fmt.Errorf("configuration parsing error: %v", err)
 	}
-	InitUrl()
+	return m, nil
 }
 
-func getUrl() (*common.Reference, string) {
-	dbRef, password, err := common.NewReference(c.Database.Url)
+func parseMapping(mapFile string) {
+	m, err := LoadMapping(mapFile)
 	if err != nil {
-		services.ServerMessage("Database URL incorrect: %v", err)
-		log.Log.Fatal("Database URL incorrect: " + c.Database.Url)
-	}
-	if password == "" {
-		password = os.Getenv("MQTT_STORE_PASS")
+		services.ServerErrorMessage("Configuration error: %v", err)
+		log.Log.Fatalf("Configuration error: %v", err)
 	}
-	if dbRef.User == "" {
-		dbRef.User = os.Getenv("MQTT_STORE_USER")
-		if dbRef.User == "" {
-			dbRef.User = c.Database.Username
-		}
-	}
-	if dbRef.User == "" {
-		dbRef.User = "admin"
+	err = defaultService.setMapping(m)
+	if err != nil {
+		services.ServerErrorMessage("Configuration mapping error: %v", err)
+		log.Log.Fatalf("Mapping error: %v", err)
 	}
-	dbRef.Options = append(dbRef.Options, fmt.Sprintf("application_name=MQTT2db %s", BuildVersion))
-	return dbRef, password
+	InitUrl()
 }
 
+// InitUrl take the database URL of the default service out of the
+// MQTT_STORE_URL environment variable if defined
 func InitUrl() {
+	c := defaultService.config.Mapping
 	url := os.Getenv("MQTT_STORE_URL")
 	if url == "" {
-		if c.Database.Url == "" {
+		if c.Database.Url == "" && c.usesDatabase() {
 			services.ServerMessage("Table MQTT_STORE_URL parameter not defined...")
 			log.Log.Fatal("Table MQTT_STORE_URL parameter not defined...")
 		}
@@ -151,148 +336,154 @@ func InitUrl() {
 
 }
 
-func (topic *Topic) createEntry(x map[string]interface{}) map[string]interface{} {
+// createEntry create destination entry out of the message. An error is
+// returned if the message does not pass the validation of the mapping.
+func (topic *Topic) createEntry(x map[string]interface{}, received time.Time) (map[string]interface{}, error) {
 	m := make(map[string]interface{})
 	log.Log.Debugf("Create mapping entry by %#v", x)
 	for _, e := range topic.Mapping {
 		log.Log.Debugf("From source %s", e.Source)
-		mNames := strings.Split(e.Source, "/")
-		var i interface{}
-		i = x
-		skip := false
-		for _, s := range mNames {
-			log.Log.Debugf("Take %s", s)
-			if subMap, ok := i.(map[string]interface{})[s]; ok {
-				i = subMap
-			} else {
-				skip = true
-				break
+		var f interface{}
+		if e.Source == ReceiveTimeSource {
+			f = received
+		} else if i, ok := sourceValue(x, e.Source); ok {
+			log.Log.Debugf("Destination %s = %v (%s)", e.Destination, i, e.Type)
+			var err error
+			f, err = e.mtype.value(i)
+			if err == nil {
+				err = e.validate(f)
 			}
-		}
-		if skip {
-			log.Log.Debugf("Skip mapping for source %s because not found", e.Source)
-			continue
-		}
-		log.Log.Debugf("Destination %s = %v (%s)", e.Destination, i, e.Type)
-		// t := reflect.TypeOf(e.Type)
-		f, err := reflectType(e.Type, i)
-		if err != nil {
-			log.Log.Errorf("Error occurred while reflecting type %s: %v", e.Source, err)
-			continue
-		}
-		switch v := f.(type) {
-		case int64:
-			if e.IfNegative != "" && v < 0 {
-				m[e.IfNegative] = -v
-				m[e.Destination] = int64(0)
-			} else {
-				if v, ok := m[e.Destination]; ok {
-					log.Log.Debugf("Already set %s to %v", e.Destination, v)
-					if v == nil {
-						m[e.Destination] = f
-					}
-				} else {
-					m[e.Destination] = f
+			if err != nil {
+				if e.Required || errors.Is(err, errInvalid) {
+					return nil, fmt.Errorf("field %s: %v", e.Source, err)
+				}
+				log.Log.Errorf("Error occurred while converting type %s: %v", e.Source, err)
+				if _, ok := m[e.Destination]; !ok && e.mtype.nullable {
+					m[e.Destination] = nil
 				}
+				continue
 			}
-		case float64:
-			if e.IfNegative != "" && v < 0 {
-				m[e.IfNegative] = -v
-				m[e.Destination] = float64(0)
-			} else {
-				if v, ok := m[e.Destination]; ok {
-					if v == nil {
-						m[e.Destination] = f
-					}
-				} else {
-					m[e.Destination] = f
+		} else {
+			if e.Required {
+				return nil, fmt.Errorf("required field %s missing", e.Source)
+			}
+			log.Log.Debugf("Skip mapping for source %s because not found", e.Source)
+			if len(e.When) == 0 {
+				if _, ok := m[e.Destination]; !ok && e.mtype.nullable {
+					m[e.Destination] = nil
 				}
+				continue
+			}
+		}
+		actions := e.route(x, f)
+		if len(actions) == 0 {
+			if f == nil {
+				continue
+			}
+			if v, ok := m[e.Destination]; ok && v != nil {
+				log.Log.Debugf("Already set %s to %v", e.Destination, v)
+				continue
 			}
-		default:
 			m[e.Destination] = f
+			log.Log.Debugf("Type %s -> %T %v", e.Type, f, f)
+			continue
+		}
+		for _, a := range actions {
+			destination, v, ok := a.apply(&e, f)
+			if ok {
+				log.Log.Debugf("Conditional %s -> %T %v", destination, v, v)
+				m[destination] = v
+			}
+		}
+	}
+	return m, nil
+}
+
+// sourceValue search the value of the source path in the message
+func sourceValue(x map[string]interface{}, source string) (interface{}, bool) {
+	var i interface{}
+	i = x
+	for _, s := range strings.Split(source, "/") {
+		log.Log.Debugf("Take %s", s)
+		subMap, ok := i.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if i, ok = subMap[s]; !ok {
+			return nil, false
 		}
-		log.Log.Debugf("Type %s -> %T %v", e.Type, f, f)
 	}
-	return m
+	return i, true
 }
 
-func reflectType(fdType string, i interface{}) (interface{}, error) {
-	var t reflect.Type
-	switch fdType {
-	case "int64":
-		t = reflect.TypeOf(int64(0))
-	case "float64":
-		t = reflect.TypeOf(float64(0))
-	case "string":
-		t = reflect.TypeOf("")
-	case "time.Time":
-		t = reflect.TypeOf(time.Now())
+// ParseMessage map the received message to the destination entry. The
+// receive time is used for the ReceiveTimeSource keyword and as fallback
+// time stamp. Returns nil if the message is rejected.
+func (topic *Topic) ParseMessage(x map[string]interface{}, received time.Time) map[string]interface{} {
+	em, err := topic.parseMessage(&topic.service.counters, topic.Name, x, received)
+	if err != nil {
+		payload, _ := json.Marshal(x)
+		topic.rejectMessage(payload, received, err)
+		return nil
+	}
+	return em
+}
 
+// parseMessage map the message received on the MQTT topic name, counter
+// states are kept per received topic in the store
+func (topic *Topic) parseMessage(store *counterStore, name string, x map[string]interface{}, received time.Time) (map[string]interface{}, error) {
+	if topic.AutoMap {
+		topic.autoMap(x)
 	}
-	o := reflect.New(t)
-	o = o.Elem()
-	log.Log.Debugf("Resolve %s destType=%v %T", fdType, i, i)
-	switch fdType {
-	case "time.Time":
-		t := i.(string)
-		l := layout
-		if strings.HasSuffix(t, "Z") {
-			l = uatLayout
-		}
-		tn, err := time.ParseInLocation(l, i.(string), time.Local)
+	em, err := topic.createEntry(x, received)
+	if err != nil {
+		return nil, err
+	}
+	if len(em) == 0 {
+		return nil, fmt.Errorf("no mapped field found")
+	}
+	if topic.Timestamp != nil {
+		err = topic.Timestamp.adapt(topic.Name, em, received)
 		if err != nil {
-			services.ServerMessage("Parse time location failed: %v (%s)", err, i.(string))
-			debug.PrintStack()
-			log.Log.Fatalf("Parse time location failed: %v", err)
+			return nil, err
 		}
-		v := reflect.ValueOf(tn)
-		o.Set(v)
-	// case "float64":
-	// 	i64 := i.(int64)
-	// 	fl64 := float64(i64)
-	// 	v := reflect.ValueOf(fl64)
-	// 	o.Set(v)
-	case "int64":
-		i64 := i.(float64)
-		fl64 := int64(i64)
-		v := reflect.ValueOf(fl64)
-		o.Set(v)
-	case "float64":
-		switch i.(type) {
-		case int64:
-			i64 := i.(int64)
-			fl64 := float64(i64)
-			v := reflect.ValueOf(fl64)
-			o.Set(v)
-		case float64:
-			i64 := i.(float64)
-			fl64 := float64(i64)
-			v := reflect.ValueOf(fl64)
-			o.Set(v)
-		case string:
-			if fl64, err := strconv.ParseFloat(i.(string), 64); err == nil {
-				v := reflect.ValueOf(fl64)
-				o.Set(v)
-			}
-		default:
-			log.Log.Errorf("Unknown type for float64 mapping: %T %v", i, i)
-			return nil, fmt.Errorf("unknown type for float64 mapping: %T %v", i, i)
-		}
-	default:
-		v := reflect.ValueOf(i)
-		o.Set(v)
 	}
-	return o.Interface(), nil
+	topic.applyCounters(store, name, em, received)
+	log.Log.Debugf("Return dynamic %v", em)
+	topic.service.counter.Add(1)
+	return em, nil
 }
 
-func (topic *Topic) ParseMessage(x map[string]interface{}) map[string]interface{} {
-	em := topic.createEntry(x)
-	if em != nil {
-		log.Log.Debugf("Return dynamic %v", em)
-		counter++
-		return em
-	}
-	services.ServerMessage("No dynamic parsing mapping")
-	log.Log.Fatalf("Mapping not defined for topic: %s", topic.Name)
-	return nil
+// ParsePayload parse the JSON payload of the message and map it to the
+// destination entry. Filter and sample policy are applied before mapping.
+// If the raw column is defined, the complete payload is added to the
+// entry. Returns nil if the message is ignored or rejected.
+func (topic *Topic) ParsePayload(payload []byte, received time.Time) map[string]interface{} {
+	return topic.parsePayload(topic.Name, payload, received)
+}
+
+// parsePayload parse the payload received on the MQTT topic name, which
+// may differ from the topic name of wildcard subscriptions
+func (topic *Topic) parsePayload(name string, payload []byte, received time.Time) map[string]interface{} {
+	x := make(map[string]interface{})
+	err := json.Unmarshal(payload, &x)
+	if err != nil {
+		log.Log.Debugf("JSON unmarshal fails for payload: %s", string(payload))
+		topic.rejectMessage(payload, received, fmt.Errorf("JSON unmarshal fails: %v", err))
+		return nil
+	}
+	if !topic.accept(x, received) {
+		topic.metrics().ignored.Add(1)
+		return nil
+	}
+	em, err := topic.parseMessage(&topic.service.counters, name, x, received)
+	if err != nil {
+		topic.rejectMessage(payload, received, err)
+		return nil
+	}
+	topic.metrics().parsed.Add(1)
+	if topic.RawColumn != "" {
+		em[topic.RawColumn] = string(payload)
+	}
+	return em
 }
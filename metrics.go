@@ -0,0 +1,240 @@
+/*
+* Copyright 2023-2025 Thorsten A. Knieling
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*    http://www.apache.org/licenses/LICENSE-2.0
+*
+ */
+
+package mqtt2db
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tknie/log"
+	"github.com/tknie/services"
+)
+
+const databasePingInterval = 30 * time.Second
+
+// HTTP optional HTTP server providing the metrics and health endpoints
+type HTTP struct {
+	Listen string `yaml:"listen"`
+}
+
+var insertBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+type histogram struct {
+	lock   sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type topicMetrics struct {
+	received    atomic.Uint64
+	parsed      atomic.Uint64
+	ignored     atomic.Uint64
+	rejected    atomic.Uint64
+	stored      atomic.Uint64
+	lastMessage atomic.Int64
+	stale       atomic.Bool
+	alerts      atomic.Uint64
+	insert      histogram
+}
+
+type serviceMetrics struct {
+	lock                sync.Mutex
+	topics              map[string]*topicMetrics
+	databaseUp          atomic.Bool
+	mqttConnected       atomic.Bool
+	mqttSubscribed      atomic.Bool
+	mqttReconnects      atomic.Uint64
+	mqttConnectFailures atomic.Uint64
+}
+
+// metricsFor metrics of the topic, kept across configuration reloads
+func (s *Service) metricsFor(name string) *topicMetrics {
+	s.metrics.lock.Lock()
+	defer s.metrics.lock.Unlock()
+	m, ok := s.metrics.topics[name]
+	if !ok {
+		m = &topicMetrics{insert: histogram{counts: make([]uint64, len(insertBuckets))}}
+		s.metrics.topics[name] = m
+	}
+	return m
+}
+
+func (topic *Topic) metrics() *topicMetrics {
+	return topic.service.metricsFor(topic.Name)
+}
+
+func (h *histogram) observe(v float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for i, b := range insertBuckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// Handler HTTP handler of the metrics and health endpoints, used to
+// serve them by an embedding HTTP server
+func (s *Service) Handler() http.Handler {
+	for _, topic := range s.config.Mapping.Topic {
+		s.metricsFor(topic.Name)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.metricsHandler)
+	mux.HandleFunc("/healthz", healthHandler)
+	mux.HandleFunc("/readyz", s.readyHandler)
+	return mux
+}
+
+// startHTTP start the HTTP server if configured
+func (s *Service) startHTTP() {
+	c := s.config.Mapping
+	if c.HTTP == nil || c.HTTP.Listen == "" {
+		return
+	}
+	s.httpServer = &http.Server{Addr: c.HTTP.Listen, Handler: s.Handler()}
+	go func() {
+		services.ServerMessage("Start HTTP server on %s", c.HTTP.Listen)
+		err := s.httpServer.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			services.ServerMessage("HTTP server failed: %v", err)
+			log.Log.Errorf("HTTP server failed: %v", err)
+		}
+	}()
+}
+
+// loopDatabasePing periodically check the database connection
+func (s *Service) loopDatabasePing() {
+	for {
+		if s.db != nil {
+			s.storeLock.Lock()
+			err := s.db.Ping()
+			s.storeLock.Unlock()
+			if err != nil {
+				log.Log.Errorf("Database ping failed: %v", err)
+			}
+			s.metrics.databaseUp.Store(err == nil)
+		}
+		select {
+		case <-s.done:
+			return
+		case <-time.After(databasePingInterval):
+		}
+	}
+}
+
+func (s *Service) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.writeMetrics(w)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeMetrics write all metrics in the Prometheus text format
+func (s *Service) writeMetrics(w io.Writer) {
+	s.metrics.lock.Lock()
+	names := make([]string, 0, len(s.metrics.topics))
+	for name := range s.metrics.topics {
+		names = append(names, name)
+	}
+	s.metrics.lock.Unlock()
+	slices.Sort(names)
+
+	counters := []struct {
+		name  string
+		help  string
+		value func(m *topicMetrics) uint64
+	}{
+		{"mqtt2db_messages_received_total", "MQTT messages received", func(m *topicMetrics) uint64 { return m.received.Load() }},
+		{"mqtt2db_messages_parsed_total", "MQTT messages mapped", func(m *topicMetrics) uint64 { return m.parsed.Load() }},
+		{"mqtt2db_messages_ignored_total", "MQTT messages ignored by filter or sample policy", func(m *topicMetrics) uint64 { return m.ignored.Load() }},
+		{"mqtt2db_messages_rejected_total", "MQTT messages rejected", func(m *topicMetrics) uint64 { return m.rejected.Load() }},
+		{"mqtt2db_rows_stored_total", "Rows stored into the database", func(m *topicMetrics) uint64 { return m.stored.Load() }},
+		{"mqtt2db_stale_alerts_total", "Alerts of topics silent longer than their maximum silence", func(m *topicMetrics) uint64 { return m.alerts.Load() }},
+	}
+	for _, cm := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", cm.name, cm.help, cm.name)
+		for _, name := range names {
+			fmt.Fprintf(w, "%s{topic=\"%s\"} %d\n", cm.name, labelEscaper.Replace(name), cm.value(s.metricsFor(name)))
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP mqtt2db_last_message_timestamp_seconds Time of the last message received\n")
+	fmt.Fprintf(w, "# TYPE mqtt2db_last_message_timestamp_seconds gauge\n")
+	for _, name := range names {
+		last := s.metricsFor(name).lastMessage.Load()
+		if last == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "mqtt2db_last_message_timestamp_seconds{topic=\"%s\"} %s\n", labelEscaper.Replace(name),
+			strconv.FormatFloat(float64(last)/1e9, 'f', 3, 64))
+	}
+
+	fmt.Fprintf(w, "# HELP mqtt2db_topic_stale Topic silent longer than its maximum silence\n")
+	fmt.Fprintf(w, "# TYPE mqtt2db_topic_stale gauge\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "mqtt2db_topic_stale{topic=\"%s\"} %d\n", labelEscaper.Replace(name),
+			boolMetric(s.metricsFor(name).stale.Load()))
+	}
+
+	fmt.Fprintf(w, "# HELP mqtt2db_insert_duration_seconds Duration of database inserts\n")
+	fmt.Fprintf(w, "# TYPE mqtt2db_insert_duration_seconds histogram\n")
+	for _, name := range names {
+		h := &s.metricsFor(name).insert
+		label := labelEscaper.Replace(name)
+		h.lock.Lock()
+		for i, b := range insertBuckets {
+			fmt.Fprintf(w, "mqtt2db_insert_duration_seconds_bucket{topic=\"%s\",le=\"%s\"} %d\n", label,
+				strconv.FormatFloat(b, 'f', -1, 64), h.counts[i])
+		}
+		fmt.Fprintf(w, "mqtt2db_insert_duration_seconds_bucket{topic=\"%s\",le=\"+Inf\"} %d\n", label, h.count)
+		fmt.Fprintf(w, "mqtt2db_insert_duration_seconds_sum{topic=\"%s\"} %s\n", label, strconv.FormatFloat(h.sum, 'f', -1, 64))
+		fmt.Fprintf(w, "mqtt2db_insert_duration_seconds_count{topic=\"%s\"} %d\n", label, h.count)
+		h.lock.Unlock()
+	}
+
+	gauges := []struct {
+		name  string
+		help  string
+		value uint64
+	}{
+		{"mqtt2db_database_up", "Database connection state", boolMetric(s.metrics.databaseUp.Load())},
+		{"mqtt2db_mqtt_connected", "MQTT connection state", boolMetric(s.metrics.mqttConnected.Load())},
+		{"mqtt2db_queue_depth", "Received MQTT messages waiting to be stored", uint64(len(s.messages))},
+	}
+	for _, g := range gauges {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", g.name, g.help, g.name, g.name, g.value)
+	}
+	fmt.Fprintf(w, "# HELP mqtt2db_mqtt_reconnects_total MQTT reconnects after a lost connection\n")
+	fmt.Fprintf(w, "# TYPE mqtt2db_mqtt_reconnects_total counter\n")
+	fmt.Fprintf(w, "mqtt2db_mqtt_reconnects_total %d\n", s.metrics.mqttReconnects.Load())
+	fmt.Fprintf(w, "# HELP mqtt2db_mqtt_connect_failures_total Failed MQTT connection attempts\n")
+	fmt.Fprintf(w, "# TYPE mqtt2db_mqtt_connect_failures_total counter\n")
+	fmt.Fprintf(w, "mqtt2db_mqtt_connect_failures_total %d\n", s.metrics.mqttConnectFailures.Load())
+}
+
+func boolMetric(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -13,12 +13,11 @@ package mqtt2db
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"net"
 	"os"
-	"os/signal"
-	"syscall"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/eclipse/paho.golang/paho"
@@ -26,106 +25,182 @@ import (
 	"github.com/tknie/services"
 )
 
+const (
+	mqttReconnectDelay    = time.Second
+	mqttMaxReconnectDelay = time.Minute
+	mqttReconnectTimeout  = 30 * time.Second
+)
+
 const layout = "2006-01-02T15:04:05"
 const uatLayout = "2006-01-02T15:04:05Z"
 
-var counter = uint64(0)
-var mqttDone = make(chan bool, 1)
-
 const DefaultLoopSeconds = 120
 
-var OutLoopSeconds = DefaultLoopSeconds
-var CloseIfStuck = false
+const messageQueueSize = 1000
 
-// loop loop through receiving all messages from MQTT and store them into
-// the database
-func loopIncomingMessages(msgChan chan *paho.Publish, topicMap map[string]*Topic) {
-	if OutLoopSeconds == 0 {
-		return
+// loopIncomingMessages loop through receiving all messages from MQTT and
+// store them into the database until the service is stopped
+func (s *Service) loopIncomingMessages(topicMap map[string]*Topic) {
+	defer close(s.loopDone)
+	loopSeconds := s.config.LoopSeconds
+	if s.config.Mapping.Mqtt.LoopIntervalSeconds > 0 {
+		loopSeconds = s.config.Mapping.Mqtt.LoopIntervalSeconds
+	}
+	if loopSeconds > 0 {
+		go s.loopCounterOutput(loopSeconds)
+	}
+	topics := make([]*Topic, 0, len(topicMap))
+	for _, topic := range topicMap {
+		topics = append(topics, topic)
+	}
+	go s.loopAggregateFlush(topics)
+	go s.loopSinkFlush()
+	if slices.ContainsFunc(topics, func(t *Topic) bool { return t.Rollup != nil }) {
+		if err := s.openHandler(&s.rollupDB); err != nil {
+			services.ServerMessage("Error initializing rollup handler: %v", err)
+		} else {
+			go s.loopRollup()
+		}
+	}
+	if slices.ContainsFunc(topics, func(t *Topic) bool { return t.MaxSilence > 0 }) {
+		go s.loopStaleness(topics)
 	}
-	go loopCounterAndCancelOutput()
-	for m := range msgChan {
+	if slices.ContainsFunc(topics, func(t *Topic) bool { return t.Partition != nil }) {
+		go s.loopPartitions(topics)
+	}
+	if slices.ContainsFunc(topics, func(t *Topic) bool { return t.Retention != nil }) {
+		go s.loopRetention()
+	}
+	hooks := &s.config.Hooks
+	for {
+		var m *paho.Publish
+		select {
+		case <-s.done:
+			return
+		case m = <-s.messages:
+		}
+		received := time.Now()
 		log.Log.Debugf("%s: Message: %s", m.Topic, string(m.Payload))
-		if topic, ok := topicMap[m.Topic]; ok {
-			x := make(map[string]interface{})
+		if hooks.OnMessage != nil {
+			hooks.OnMessage(m.Topic, m.Payload)
+		}
+		if topic := matchTopic(topicMap, m.Topic); topic != nil {
+			tm := topic.metrics()
+			tm.received.Add(1)
+			tm.lastMessage.Store(received.UnixNano())
 			log.Log.Debugf("EVENT....%s", string(m.Payload))
-			err := json.Unmarshal(m.Payload, &x)
-			if err != nil {
-				fmt.Println("JSON unmarshal fails:", err)
-				fmt.Println("JSON unmarshal fails for payload:", string(m.Payload))
-				continue
-			}
-
-			em := topic.ParseMessage(x)
-			if em != nil {
-				topic.storeEvent(em)
+			em := topic.parsePayload(m.Topic, m.Payload, received)
+			if em != nil && (hooks.OnEntry == nil || hooks.OnEntry(topic, em)) {
+				if topic.Aggregate != nil {
+					topic.aggregate(m.Topic, em, received)
+				} else {
+					topic.storeEvent(em)
+				}
 				os.Stdout.Sync()
 			}
 		}
 	}
 }
 
-func loopCounterAndCancelOutput() {
-	lastCounter := uint64(0)
-	try := 0
+// matchTopic search the topic subscription matching the MQTT topic name
+// including wildcard subscriptions using '+' and '#'
+func matchTopic(topicMap map[string]*Topic, name string) *Topic {
+	if topic, ok := topicMap[name]; ok {
+		return topic
+	}
+	for filter, topic := range topicMap {
+		if topicFilterMatch(filter, name) {
+			return topic
+		}
+	}
+	return nil
+}
+
+func topicFilterMatch(filter, name string) bool {
+	f := strings.Split(filter, "/")
+	n := strings.Split(name, "/")
+	for i, level := range f {
+		switch {
+		case level == "#":
+			return true
+		case i >= len(n):
+			return false
+		case level != "+" && level != n[i]:
+			return false
+		}
+	}
+	return len(f) == len(n)
+}
+
+func (s *Service) loopCounterOutput(loopSeconds int) {
 	for {
 		select {
-		case <-mqttDone:
+		case <-s.done:
 			services.ServerMessage("Ecoflow analyze loop is stopped")
 			return
-		case <-time.After(time.Second * time.Duration(OutLoopSeconds)):
-			services.ServerMessage("Received MQTT msgs: %04d", counter)
-			if counter == lastCounter && CloseIfStuck {
-				if try > 10 {
-					services.ServerMessage("Received MQTT msgs error still stuck")
-					os.Exit(10)
-				}
-				try++
-			} else {
-				try = 0
-			}
-			lastCounter = counter
+		case <-time.After(time.Second * time.Duration(loopSeconds)):
+			services.ServerMessage("Received MQTT msgs: %04d", s.counter.Load())
 		}
 	}
 }
 
-func tryConnectMQTT(server string, tries int) net.Conn {
+func (s *Service) tryConnectMQTT(server string, tries int) (net.Conn, error) {
 	var err error
 	var conn net.Conn
 	for count := 0; count < tries; count++ {
 		conn, err = net.Dial("tcp", server)
 		if err == nil {
-			return conn
+			return conn, nil
 		}
-		if count < tries {
+		s.metrics.mqttConnectFailures.Add(1)
+		if count < tries-1 {
 			services.ServerMessage("Error connecting MQTT retrying soon ... %v", err)
 			time.Sleep(10 * time.Second)
 		} else {
 			services.ServerMessage("Error connecting MQTT ... %v", err)
 		}
 	}
+	return nil, fmt.Errorf("failed to dial to %s: %v", server, err)
+}
+
+// connectMQTT connect to the MQTT server and subscribe all topics
+func (s *Service) connectMQTT(ctx context.Context) error {
+	c := s.config.Mapping
+	tries := s.config.MaxTries
+	if tries <= 0 {
+		tries = 1
+	}
+	services.ServerMessage("Connect TCP/IP to %s", c.Mqtt.Server)
+	conn, err := s.tryConnectMQTT(c.Mqtt.Server, tries)
 	if err != nil {
-		log.Log.Fatalf("Failed to dial to %s: %s", server, err)
+		return err
 	}
-	return nil
+	return s.openMQTT(ctx, conn)
 }
 
-func (config *Config) ConnectMQTT() {
+// openMQTT connect the paho client on the connection and subscribe all
+// topics. A lost connection of the client triggers the reconnect.
+func (s *Service) openMQTT(ctx context.Context, conn net.Conn) error {
+	c := s.config.Mapping
 	logger := &MQTTWrapperLogger{}
-	msgChan := make(chan *paho.Publish)
-
-	if c.Mqtt.LoopIntervalSeconds > 0 {
-		OutLoopSeconds = c.Mqtt.LoopIntervalSeconds
-	}
 
-	services.ServerMessage("Connect TCP/IP to %s", c.Mqtt.Server)
-	conn := tryConnectMQTT(c.Mqtt.Server, config.MaxTries)
-
-	pahoClient := paho.NewClient(paho.ClientConfig{PacketTimeout: 2 * time.Minute,
+	var pahoClient *paho.Client
+	pahoClient = paho.NewClient(paho.ClientConfig{PacketTimeout: 2 * time.Minute,
 		Router: paho.NewStandardRouterWithDefault(func(m *paho.Publish) {
-			msgChan <- m
+			select {
+			case s.messages <- m:
+			case <-s.done:
+			}
 		}),
 		Conn: conn,
+		OnClientError: func(err error) {
+			services.ServerMessage("MQTT client error: %v", err)
+			s.connectionLost(pahoClient)
+		},
+		OnServerDisconnect: func(d *paho.Disconnect) {
+			services.ServerMessage("MQTT server disconnected with reason code %d", d.ReasonCode)
+			s.connectionLost(pahoClient)
+		},
 	})
 	pahoClient.SetDebugLogger(logger)
 	pahoClient.SetErrorLogger(logger)
@@ -136,7 +211,7 @@ func (config *Config) ConnectMQTT() {
 	// connect to MQTT and listen and subscribe
 	cp := &paho.Connect{
 		KeepAlive:  30,
-		ClientID:   config.Clientid,
+		ClientID:   s.config.ClientID,
 		CleanStart: true,
 		Username:   c.Mqtt.Username,
 		Password:   []byte(password),
@@ -149,54 +224,135 @@ func (config *Config) ConnectMQTT() {
 		cp.PasswordFlag = true
 	}
 
+	err := s.subscribeMQTT(ctx, pahoClient, cp)
+	if err != nil {
+		pahoClient.Disconnect(&paho.Disconnect{ReasonCode: 0})
+		return err
+	}
+	s.mqttLock.Lock()
+	s.client = pahoClient
+	s.mqtt = pahoClient
+	s.mqttLock.Unlock()
+	s.metrics.mqttConnected.Store(true)
+	s.metrics.mqttSubscribed.Store(true)
+	return nil
+}
+
+// subscribeMQTT connect the client and subscribe all topics
+func (s *Service) subscribeMQTT(ctx context.Context, pahoClient *paho.Client, cp *paho.Connect) error {
+	c := s.config.Mapping
 	// connecting to MQTT server
-	ca, err := pahoClient.Connect(context.Background(), cp)
+	ca, err := pahoClient.Connect(ctx, cp)
 	if err != nil {
-		services.ServerMessage("Error to connect paho services to %s with %s: %v",
+		return fmt.Errorf("error to connect paho services to %s with %s: %v",
 			c.Mqtt.Server, c.Mqtt.Username, err)
-		log.Log.Fatalf("Error to connect paho services to %s with %s: %v", c.Mqtt.Server, c.Mqtt.Username, err)
 	}
 	if ca.ReasonCode != 0 {
-		services.ServerMessage("Failed to connect paho services to %s with %s with reason code %d",
-			c.Mqtt.Server, c.Mqtt.Username, ca.ReasonCode)
-
-		log.Log.Fatalf("Failed to connect to %s : %d - %s", c.Mqtt.Server, ca.ReasonCode, ca.Properties.ReasonString)
+		return fmt.Errorf("failed to connect to %s with %s: %d - %s", c.Mqtt.Server, c.Mqtt.Username,
+			ca.ReasonCode, ca.Properties.ReasonString)
 	}
 
 	services.ServerMessage("Connecting MQTT to %s", c.Mqtt.Server)
 
-	ic := make(chan os.Signal, 1)
-	signal.Notify(ic, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-ic
-		fmt.Println("signal received, exiting")
-		if c != nil {
-			d := &paho.Disconnect{ReasonCode: 0}
-			pahoClient.Disconnect(d)
-		}
-		os.Exit(0)
-	}()
-
-	topicMap := make(map[string]*Topic)
 	// subscribe to a subscription MQTT topic
 	subscriptions := make([]paho.SubscribeOptions, 0)
 	for _, topic := range c.Topic {
-		topicMap[topic.Name] = topic
 		subscriptions = append(subscriptions, paho.SubscribeOptions{Topic: topic.Name,
-			QoS: byte(config.Qos)})
+			QoS: byte(s.config.Qos)})
 
 		services.ServerMessage("Subscribed MQTT to %s", topic.Name)
 		services.ServerMessage("Storage of MQTT data to table '%s'", topic.StoreTablename)
 	}
-	sa, err := pahoClient.Subscribe(context.Background(), &paho.Subscribe{
+	sa, err := pahoClient.Subscribe(ctx, &paho.Subscribe{
 		Subscriptions: subscriptions,
 	})
 	if err != nil {
-		services.ServerMessage("Error subscribing MQTT ... %v", err)
-		log.Log.Fatalf("Error subscribing MQTT ... %v", err)
+		return fmt.Errorf("error subscribing MQTT: %v", err)
+	}
+	for i, reason := range sa.Reasons {
+		if reason != byte(s.config.Qos) {
+			return fmt.Errorf("failed to subscribe to %v: %d", subscriptions[i].Topic, reason)
+		}
+	}
+	return nil
+}
+
+// connectionLost trigger the reconnect if the connection of the current
+// client is lost. Errors of replaced clients are ignored.
+func (s *Service) connectionLost(pahoClient *paho.Client) {
+	s.mqttLock.Lock()
+	current := s.client == pahoClient
+	if current {
+		s.client = nil
+	}
+	s.mqttLock.Unlock()
+	if !current {
+		return
+	}
+	s.metrics.mqttConnected.Store(false)
+	s.metrics.mqttSubscribed.Store(false)
+	select {
+	case s.reconnect <- struct{}{}:
+	default:
+	}
+}
+
+// loopReconnectMQTT reconnect to the MQTT server after the connection is
+// lost and subscribe all topics again. The delay between the attempts is
+// doubled up to mqttMaxReconnectDelay.
+func (s *Service) loopReconnectMQTT() {
+	server := s.config.Mapping.Mqtt.Server
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.reconnect:
+		}
+		delay := mqttReconnectDelay
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-time.After(delay):
+			}
+			err := s.reconnectMQTT(server)
+			if err == nil {
+				s.metrics.mqttReconnects.Add(1)
+				services.ServerMessage("Reconnected MQTT to %s", server)
+				break
+			}
+			services.ServerMessage("Error reconnecting MQTT to %s: %v", server, err)
+			delay = min(2*delay, mqttMaxReconnectDelay)
+		}
+	}
+}
+
+// reconnectMQTT dial the MQTT server and connect a new client
+func (s *Service) reconnectMQTT(server string) error {
+	conn, err := net.DialTimeout("tcp", server, mqttReconnectTimeout)
+	if err != nil {
+		s.metrics.mqttConnectFailures.Add(1)
+		return err
 	}
-	if sa.Reasons[0] != byte(config.Qos) {
-		log.Log.Fatalf("Failed to subscribe to %v : %d", subscriptions, sa.Reasons[0])
+	ctx, cancel := context.WithTimeout(context.Background(), mqttReconnectTimeout)
+	defer cancel()
+	return s.openMQTT(ctx, conn)
+}
+
+// mqttClient MQTT client of the service, replaced on reconnect
+func (s *Service) mqttClient() MQTTClient {
+	s.mqttLock.Lock()
+	defer s.mqttLock.Unlock()
+	return s.mqtt
+}
+
+// disconnectMQTT disconnect the client connected by the service
+func (s *Service) disconnectMQTT() {
+	s.mqttLock.Lock()
+	client := s.client
+	s.client = nil
+	s.mqttLock.Unlock()
+	if client != nil {
+		client.Disconnect(&paho.Disconnect{ReasonCode: 0})
 	}
-	loopIncomingMessages(msgChan, topicMap)
 }
@@ -0,0 +1,256 @@
+/*
+* Copyright 2023-2025 Thorsten A. Knieling
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*    http://www.apache.org/licenses/LICENSE-2.0
+*
+ */
+
+package mqtt2db
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tknie/flynn/common"
+	"github.com/tknie/flynn/dbsql"
+	"github.com/tknie/log"
+	"github.com/tknie/services"
+)
+
+const (
+	defaultPartitionAhead = 2
+	partitionInterval     = 24 * time.Hour
+)
+
+var partitionPeriods = []string{"month", "year"}
+
+// Partition time partitioning of the store table. Postgres uses native
+// range partitions, other databases a table per period named
+// '<storeTablename>_<yyyy>_<mm>' or '<storeTablename>_<yyyy>'.
+type Partition struct {
+	Period string `yaml:"period"`
+	Column string `yaml:"column,omitempty"`
+	Ahead  int    `yaml:"ahead,omitempty"`
+}
+
+type partitionState struct {
+	lock    sync.Mutex
+	created map[string]bool
+}
+
+func (topic *Topic) checkPartition() error {
+	if !slices.Contains(partitionPeriods, topic.Partition.Period) {
+		return fmt.Errorf("unknown partition period '%s' for topic '%s'", topic.Partition.Period, topic.Name)
+	}
+	if topic.partitionColumn() == "" {
+		return fmt.Errorf("partition column missing for topic '%s'", topic.Name)
+	}
+	topic.partition = &partitionState{created: make(map[string]bool)}
+	return nil
+}
+
+func (topic *Topic) partitionColumn() string {
+	if topic.Partition.Column != "" {
+		return topic.Partition.Column
+	}
+	return topic.timeColumn()
+}
+
+func (topic *Topic) nativePartition() bool {
+	return topic.Partition != nil && topic.service.driver == common.PostgresType
+}
+
+func (topic *Topic) partitionName(start time.Time) string {
+	if topic.Partition.Period == "year" {
+		return fmt.Sprintf("%s_%04d", topic.StoreTablename, start.Year())
+	}
+	return fmt.Sprintf("%s_%04d_%02d", topic.StoreTablename, start.Year(), start.Month())
+}
+
+// partitionStart parse the start of the period out of the partition name
+func (topic *Topic) partitionStart(name string) (time.Time, bool) {
+	suffix, ok := strings.CutPrefix(strings.ToLower(name), strings.ToLower(topic.StoreTablename)+"_")
+	if !ok {
+		return time.Time{}, false
+	}
+	l := "2006_01"
+	if topic.Partition.Period == "year" {
+		l = "2006"
+	}
+	if len(suffix) != len(l) {
+		return time.Time{}, false
+	}
+	t, err := time.ParseInLocation(l, suffix, time.Local)
+	return t, err == nil
+}
+
+// tableFor table the row with the time stamp is stored in
+func (topic *Topic) tableFor(t time.Time) string {
+	if topic.Partition == nil || topic.nativePartition() {
+		return topic.StoreTablename
+	}
+	start, _ := periodStart(topic.Partition.Period, t)
+	return topic.partitionName(start)
+}
+
+// partitionTables list of all existing partitions ordered by time
+func (topic *Topic) partitionTables(id DatabaseClient) ([]string, error) {
+	err := id.Ping()
+	if err != nil {
+		return nil, err
+	}
+	tables, err := id.Tables()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]string, 0)
+	for _, t := range tables {
+		if _, ok := topic.partitionStart(t); ok {
+			list = append(list, t)
+		}
+	}
+	sort.Strings(list)
+	return list, nil
+}
+
+// queryTables tables containing the stored rows of the topic
+func (topic *Topic) queryTables(id DatabaseClient) ([]string, error) {
+	if topic.Partition == nil || topic.nativePartition() {
+		return []string{topic.StoreTablename}, nil
+	}
+	return topic.partitionTables(id)
+}
+
+// createPartitionedTable create the natively partitioned store table
+func (topic *Topic) createPartitionedTable(id DatabaseClient) (common.CreateStatus, error) {
+	tables, err := id.Tables()
+	if err != nil {
+		return common.CreateConnError, err
+	}
+	if slices.ContainsFunc(tables, func(s string) bool { return strings.EqualFold(s, topic.StoreTablename) }) {
+		return common.CreateExists, nil
+	}
+	columns := dbsql.CreateTableByColumns(true, topic.createColumns().([]*common.Column))
+	err = id.Batch(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s) PARTITION BY RANGE (%s)",
+		topic.StoreTablename, columns, topic.partitionColumn()))
+	if err != nil {
+		return common.CreateError, err
+	}
+	return common.CreateCreated, nil
+}
+
+// createPartition create the partition of the period containing the time
+// if not already done
+func (topic *Topic) createPartition(id DatabaseClient, t time.Time) error {
+	start, end := periodStart(topic.Partition.Period, t)
+	name := topic.partitionName(start)
+	state := topic.partition
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	if state.created[name] {
+		return nil
+	}
+	if topic.nativePartition() {
+		err := id.Batch(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM ('%s') TO ('%s')",
+			name, topic.StoreTablename, start.Format(sqlTimeLayout), end.Format(sqlTimeLayout)))
+		if err != nil {
+			return err
+		}
+	} else {
+		status, err := id.CreateTableIfNotExists(name, topic.createColumns())
+		if err != nil {
+			return err
+		}
+		if status == common.CreateCreated {
+			err = topic.initTable(id, topic.service.driver, name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	log.Log.Debugf("Partition %s available", name)
+	state.created[name] = true
+	return nil
+}
+
+// ensurePartitions create the current and the upcoming partitions
+func (topic *Topic) ensurePartitions(id DatabaseClient, now time.Time) error {
+	ahead := topic.Partition.Ahead
+	if ahead <= 0 {
+		ahead = defaultPartitionAhead
+	}
+	start, _ := periodStart(topic.Partition.Period, now)
+	for i := 0; i <= ahead; i++ {
+		err := topic.createPartition(id, start)
+		if err != nil {
+			return fmt.Errorf("partition %s: %v", topic.partitionName(start), err)
+		}
+		_, start = periodStart(topic.Partition.Period, start)
+	}
+	return nil
+}
+
+// dropPartitions drop all partitions ending before the cutoff and return
+// the number of removed rows
+func (topic *Topic) dropPartitions(id DatabaseClient, cutoff time.Time, dryRun bool) (int64, error) {
+	tables, err := topic.partitionTables(id)
+	if err != nil {
+		return 0, err
+	}
+	total := int64(0)
+	for _, name := range tables {
+		start, _ := topic.partitionStart(name)
+		if _, end := periodStart(topic.Partition.Period, start); end.After(cutoff) {
+			continue
+		}
+		p := &retentionPolicy{table: name}
+		count, err := p.count(id, time.Time{})
+		if err != nil {
+			return total, err
+		}
+		total += count
+		if dryRun {
+			services.ServerMessage("Retention would drop partition %s with %d rows", name, count)
+			continue
+		}
+		err = id.DeleteTable(name)
+		if err != nil {
+			return total, err
+		}
+		topic.partition.lock.Lock()
+		delete(topic.partition.created, name)
+		topic.partition.lock.Unlock()
+		services.ServerMessage("Retention dropped partition %s with %d rows", name, count)
+	}
+	return total, nil
+}
+
+// loopPartitions periodically create upcoming partitions
+func (s *Service) loopPartitions(topics []*Topic) {
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-time.After(partitionInterval):
+		}
+		for _, topic := range topics {
+			if topic.Partition == nil {
+				continue
+			}
+			s.storeLock.Lock()
+			err := topic.ensurePartitions(s.db, time.Now())
+			s.storeLock.Unlock()
+			if err != nil {
+				log.Log.Errorf("Error creating partitions: %v", err)
+			}
+		}
+	}
+}
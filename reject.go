@@ -0,0 +1,132 @@
+/*
+* Copyright 2023-2025 Thorsten A. Knieling
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*    http://www.apache.org/licenses/LICENSE-2.0
+*
+ */
+
+package mqtt2db
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/tknie/flynn/common"
+	"github.com/tknie/log"
+	"github.com/tknie/services"
+)
+
+// Reject dead-letter destination of rejected messages. Rejected messages
+// can be stored in a reject table, appended to a file or republished to
+// a MQTT topic.
+type Reject struct {
+	Table string `yaml:"table,omitempty"`
+	File  string `yaml:"file,omitempty"`
+	Topic string `yaml:"topic,omitempty"`
+}
+
+type rejectEntry struct {
+	Received time.Time `json:"received"`
+	Topic    string    `json:"topic"`
+	Reason   string    `json:"reason"`
+	Payload  string    `json:"payload"`
+}
+
+// rejectMessage route the rejected message together with the reason to
+// the dead-letter destination of the topic
+func (topic *Topic) rejectMessage(payload []byte, received time.Time, reason error) {
+	log.Log.Infof("Reject message of topic %s: %v", topic.Name, reason)
+	s := topic.service
+	topic.metrics().rejected.Add(1)
+	if s.config.Hooks.OnReject != nil {
+		s.config.Hooks.OnReject(topic, payload, reason)
+	}
+	reject := topic.Reject
+	if reject == nil {
+		reject = s.config.Mapping.Reject
+	}
+	if reject == nil {
+		services.ServerMessage("Reject message of topic %s: %v", topic.Name, reason)
+		return
+	}
+	entry := &rejectEntry{Received: received, Topic: topic.Name,
+		Reason: reason.Error(), Payload: string(payload)}
+	if reject.Table != "" {
+		s.storeReject(reject.Table, entry)
+	}
+	if reject.File != "" {
+		reject.appendFile(entry)
+	}
+	if reject.Topic != "" {
+		s.publishReject(reject.Topic, entry)
+	}
+}
+
+func (s *Service) storeReject(table string, entry *rejectEntry) {
+	if s.db == nil {
+		return
+	}
+	s.rejectLock.Lock()
+	defer s.rejectLock.Unlock()
+	if !s.rejectTables[table] {
+		columns := []*common.Column{
+			{Name: "received", DataType: common.CurrentTimestamp},
+			{Name: "topic", DataType: common.Alpha, Length: 255},
+			{Name: "reason", DataType: common.Alpha, Length: 255},
+			{Name: "payload", DataType: common.Text},
+		}
+		_, err := s.db.CreateTableIfNotExists(table, columns)
+		if err != nil {
+			log.Log.Errorf("Error creating reject table %s: %v", table, err)
+			return
+		}
+		s.rejectTables[table] = true
+	}
+	reason := entry.Reason
+	if len(reason) > 255 {
+		reason = reason[:255]
+	}
+	e := map[string]interface{}{"received": entry.Received, "topic": entry.Topic,
+		"reason": reason, "payload": entry.Payload}
+	keys := []string{"received", "topic", "reason", "payload"}
+	insert := &common.Entries{Fields: keys, Update: keys, Values: [][]any{{e}}}
+	_, err := s.db.Insert(table, insert)
+	if err != nil {
+		log.Log.Errorf("Error inserting reject record: %v", err)
+	}
+}
+
+func (reject *Reject) appendFile(entry *rejectEntry) {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		log.Log.Errorf("Error marshal reject entry: %v", err)
+		return
+	}
+	f, err := os.OpenFile(reject.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Log.Errorf("Error opening reject file %s: %v", reject.File, err)
+		return
+	}
+	defer f.Close()
+	_, err = f.Write(append(b, '\n'))
+	if err != nil {
+		log.Log.Errorf("Error writing reject file %s: %v", reject.File, err)
+	}
+}
+
+func (s *Service) publishReject(topic string, entry *rejectEntry) {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		log.Log.Errorf("Error marshal reject entry: %v", err)
+		return
+	}
+	err = s.publish(topic, b)
+	if err != nil {
+		log.Log.Errorf("Error publishing reject entry to %s: %v", topic, err)
+	}
+}
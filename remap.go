@@ -0,0 +1,157 @@
+/*
+* Copyright 2023-2025 Thorsten A. Knieling
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*    http://www.apache.org/licenses/LICENSE-2.0
+*
+ */
+
+package mqtt2db
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/tknie/flynn/common"
+	"github.com/tknie/log"
+	"github.com/tknie/services"
+)
+
+const remapBlocksize = 100
+
+// Remap re-run the current mapping of the topic over all stored raw
+// payloads and update the mapped columns. Missing columns are added to
+// the store table. Destinations of the receive time are not updated.
+func (s *Service) Remap(name string) error {
+	topic := s.findTopic(name)
+	if topic == nil {
+		return fmt.Errorf("topic '%s' not found", name)
+	}
+	if topic.RawColumn == "" {
+		return fmt.Errorf("topic '%s' has no raw column defined", name)
+	}
+	qid, qrelease, err := s.handler()
+	if err != nil {
+		return err
+	}
+	defer qrelease()
+	uid, urelease, err := s.handler()
+	if err != nil {
+		return err
+	}
+	defer urelease()
+
+	err = topic.adaptTable(uid, s.driver)
+	if err != nil {
+		return err
+	}
+
+	skip := []string{topic.RawColumn}
+	for _, m := range topic.Mapping {
+		if m.Source == ReceiveTimeSource {
+			skip = append(skip, m.Destination)
+		}
+	}
+
+	services.ServerMessage("Remap raw payloads of table %s", topic.StoreTablename)
+	counter := uint64(0)
+	updated := uint64(0)
+	var fields []string
+	values := make([][]any, 0, remapBlocksize)
+	flush := func() error {
+		if len(values) == 0 {
+			return nil
+		}
+		update := &common.Entries{Fields: fields, Update: []string{"id"}, Values: values}
+		_, n, err := uid.Update(topic.StoreTablename, update)
+		if err != nil {
+			return err
+		}
+		updated += uint64(n)
+		values = make([][]any, 0, remapBlocksize)
+		return nil
+	}
+	query := &common.Query{
+		TableName: topic.StoreTablename,
+		Fields:    []string{"id", topic.RawColumn},
+		Search:    topic.RawColumn + " IS NOT NULL",
+		Order:     []string{"id:ASC"},
+	}
+	_, err = qid.Query(query, func(search *common.Query, result *common.Result) error {
+		counter++
+		x, err := rawPayload(result.Rows[1])
+		if err != nil {
+			log.Log.Errorf("Skip raw payload of id %v: %v", result.Rows[0], err)
+			return nil
+		}
+		em, err := topic.createEntry(x, time.Time{})
+		if err != nil {
+			log.Log.Errorf("Skip invalid raw payload of id %v: %v", result.Rows[0], err)
+			return nil
+		}
+		row := make([]any, 0, len(em)+1)
+		keys := make([]string, 0, len(em)+1)
+		for _, k := range topic.destinations() {
+			if v, ok := em[k]; ok && !slices.Contains(skip, k) {
+				keys = append(keys, k)
+				row = append(row, v)
+			}
+		}
+		keys = append(keys, "id")
+		row = append(row, result.Rows[0])
+		// all rows of one update need the same fields
+		if !slices.Equal(keys, fields) {
+			if err := flush(); err != nil {
+				return err
+			}
+			fields = keys
+		}
+		values = append(values, row)
+		if len(values) >= remapBlocksize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		if counter%10000 == 0 {
+			services.ServerMessage("Remapped %d raw payloads", counter)
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return err
+	}
+	services.ServerMessage("Remap of %d raw payloads done, %d rows updated", counter, updated)
+	return nil
+}
+
+// Remap remap the topic of the default service
+func Remap(name string) error {
+	return defaultService.Remap(name)
+}
+
+// rawPayload convert stored raw payload column value into JSON map
+func rawPayload(raw any) (map[string]interface{}, error) {
+	x := make(map[string]interface{})
+	switch v := raw.(type) {
+	case map[string]interface{}:
+		return v, nil
+	case string:
+		err := json.Unmarshal([]byte(v), &x)
+		return x, err
+	case []byte:
+		err := json.Unmarshal(v, &x)
+		return x, err
+	case *string:
+		err := json.Unmarshal([]byte(*v), &x)
+		return x, err
+	}
+	return nil, fmt.Errorf("unknown raw payload type %T", raw)
+}
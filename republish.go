@@ -0,0 +1,259 @@
+/*
+* Copyright 2023-2025 Thorsten A. Knieling
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*    http://www.apache.org/licenses/LICENSE-2.0
+*
+ */
+
+package mqtt2db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/tknie/log"
+	"github.com/tknie/services"
+)
+
+const (
+	defaultRepublishTopic = "mqtt2db/{table}"
+	republishDialTimeout  = 10 * time.Second
+)
+
+// Republish sink publishing each mapped entry as JSON to an MQTT topic. In
+// the topic '{table}' is replaced by the store table or topic name. Without
+// mqtt the entries are published to the MQTT server of the mapping. With
+// discovery Home Assistant sensors reading the topic are announced.
+type Republish struct {
+	Topic     string     `yaml:"topic,omitempty"`
+	Mqtt      *Mqtt      `yaml:"mqtt,omitempty"`
+	Qos       int        `yaml:"qos,omitempty"`
+	Retain    bool       `yaml:"retain,omitempty"`
+	Discovery *Discovery `yaml:"discovery,omitempty"`
+}
+
+type republishSink struct {
+	service    *Service
+	config     *Republish
+	lock       sync.Mutex
+	client     *paho.Client
+	discovered map[string]bool
+	lastError  error
+}
+
+func newRepublishSink(s *Service, config *Republish) (Sink, error) {
+	if config.Qos < 0 || config.Qos > 2 {
+		return nil, fmt.Errorf("invalid QoS %d", config.Qos)
+	}
+	return &republishSink{service: s, config: config, discovered: make(map[string]bool)}, nil
+}
+
+// publishTopic output topic of the mapped entries of the topic
+func (p *Republish) publishTopic(topic *Topic) string {
+	t := p.Topic
+	if t == "" {
+		t = defaultRepublishTopic
+	}
+	return strings.ReplaceAll(t, "{table}", topic.outputName())
+}
+
+// publishPayload JSON document of the mapped entry, the raw payload is
+// not published. The units of the published columns are added as 'units'
+// object.
+func (topic *Topic) publishPayload(e map[string]interface{}) ([]byte, error) {
+	doc := make(map[string]any, len(e)+1)
+	columnUnits := topic.columnUnits()
+	units := make(map[string]string)
+	for k, v := range e {
+		if v != nil && k != topic.RawColumn {
+			doc[k] = columnValue(v)
+			if unit, ok := columnUnits[k]; ok {
+				units[k] = unit
+			}
+		}
+	}
+	if len(units) > 0 {
+		doc["units"] = units
+	}
+	return json.Marshal(doc)
+}
+
+// columnUnits units of the columns defined by the mapping. Counter rates
+// are per hour, the aggregated values except the count keep the unit.
+func (topic *Topic) columnUnits() map[string]string {
+	units := make(map[string]string)
+	add := func(column, unit string) {
+		if unit == "" {
+			return
+		}
+		units[column] = unit
+		if topic.Aggregate != nil {
+			for _, suffix := range aggregateSuffixes {
+				if suffix != "_count" {
+					units[column+suffix] = unit
+				}
+			}
+		}
+	}
+	for _, m := range topic.Mapping {
+		for _, destination := range topic.columnDestinations(&m) {
+			add(destination, m.Unit)
+		}
+		if m.Counter != nil {
+			add(m.deltaColumn(), m.Unit)
+			add(m.rateColumn(), m.rateUnit())
+		}
+	}
+	return units
+}
+
+func (sink *republishSink) Write(topic *Topic, entries []map[string]interface{}) error {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	err := sink.publish(topic, entries)
+	if err != nil && sink.client != nil {
+		// reconnect the second broker on next write
+		sink.client.Disconnect(&paho.Disconnect{ReasonCode: 0})
+		sink.client = nil
+	}
+	sink.lastError = err
+	return err
+}
+
+func (sink *republishSink) publish(topic *Topic, entries []map[string]interface{}) error {
+	client, err := sink.mqttClient()
+	if err != nil {
+		return err
+	}
+	name := sink.config.publishTopic(topic)
+	if sink.config.Discovery != nil && !sink.discovered[name] {
+		err = sink.discover(client, topic, name)
+		if err != nil {
+			return err
+		}
+	}
+	for _, e := range entries {
+		payload, err := topic.publishPayload(e)
+		if err != nil {
+			return err
+		}
+		_, err = client.Publish(context.Background(), &paho.Publish{Topic: name, QoS: byte(sink.config.Qos),
+			Retain: sink.config.Retain, Payload: payload})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// discover publish the retained Home Assistant configurations of the
+// topic once
+func (sink *republishSink) discover(client MQTTClient, topic *Topic, stateTopic string) error {
+	for _, dc := range topic.discoveryConfigs(sink.config.Discovery, stateTopic) {
+		payload, err := dc.payload()
+		if err != nil {
+			return err
+		}
+		_, err = client.Publish(context.Background(), &paho.Publish{Topic: sink.config.Discovery.discoveryTopic(dc),
+			QoS: byte(sink.config.Qos), Retain: true, Payload: payload})
+		if err != nil {
+			return err
+		}
+	}
+	sink.discovered[stateTopic] = true
+	services.ServerMessage("Published Home Assistant discovery of %s", stateTopic)
+	return nil
+}
+
+// mqttClient MQTT client of the sink, the second broker is connected on
+// first use
+func (sink *republishSink) mqttClient() (MQTTClient, error) {
+	if sink.config.Mqtt == nil || sink.config.Mqtt.Server == "" {
+		client := sink.service.mqttClient()
+		if client == nil {
+			return nil, fmt.Errorf("MQTT not connected")
+		}
+		return client, nil
+	}
+	if sink.client == nil {
+		client, err := sink.connect()
+		if err != nil {
+			return nil, err
+		}
+		sink.client = client
+	}
+	return sink.client, nil
+}
+
+// connect connect to the second MQTT server used for publishing only
+func (sink *republishSink) connect() (*paho.Client, error) {
+	m := sink.config.Mqtt
+	conn, err := net.DialTimeout("tcp", m.Server, republishDialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial to %s: %v", m.Server, err)
+	}
+	logger := &MQTTWrapperLogger{}
+	client := paho.NewClient(paho.ClientConfig{PacketTimeout: 2 * time.Minute, Conn: conn,
+		OnClientError: func(err error) {
+			services.ServerMessage("Republish MQTT client error: %v", err)
+		},
+	})
+	client.SetDebugLogger(logger)
+	client.SetErrorLogger(logger)
+	password := os.ExpandEnv(m.Password)
+	cp := &paho.Connect{
+		KeepAlive:    30,
+		ClientID:     sink.service.config.ClientID + "-republish",
+		CleanStart:   true,
+		Username:     m.Username,
+		UsernameFlag: m.Username != "",
+		Password:     []byte(password),
+		PasswordFlag: password != "",
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), republishDialTimeout)
+	defer cancel()
+	ca, err := client.Connect(ctx, cp)
+	if err != nil {
+		return nil, fmt.Errorf("error to connect to %s with %s: %v", m.Server, m.Username, err)
+	}
+	if ca.ReasonCode != 0 {
+		return nil, fmt.Errorf("failed to connect to %s with %s: %d - %s", m.Server, m.Username,
+			ca.ReasonCode, ca.Properties.ReasonString)
+	}
+	services.ServerMessage("Connected republish MQTT to %s", m.Server)
+	return client, nil
+}
+
+func (sink *republishSink) Flush() error {
+	return nil
+}
+
+func (sink *republishSink) Close() error {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	if sink.client != nil {
+		err := sink.client.Disconnect(&paho.Disconnect{ReasonCode: 0})
+		sink.client = nil
+		if err != nil {
+			log.Log.Errorf("Error disconnecting republish MQTT: %v", err)
+		}
+	}
+	return nil
+}
+
+func (sink *republishSink) Health() error {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	return sink.lastError
+}
@@ -0,0 +1,265 @@
+/*
+* Copyright 2023-2025 Thorsten A. Knieling
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*    http://www.apache.org/licenses/LICENSE-2.0
+*
+ */
+
+package mqtt2db
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/tknie/flynn/common"
+	"github.com/tknie/log"
+	"github.com/tknie/services"
+)
+
+const (
+	defaultRetentionBatchSize = 1000
+	retentionInterval         = time.Hour
+)
+
+// Retention retention policy of a topic. Rows older than MaxAge are deleted
+// or moved into MoveTable. Rollup defines the maximum age of the rows of
+// each rollup period table.
+type Retention struct {
+	MaxAge    time.Duration            `yaml:"maxAge,omitempty"`
+	Column    string                   `yaml:"column,omitempty"`
+	BatchSize int                      `yaml:"batchSize,omitempty"`
+	MoveTable string                   `yaml:"moveTable,omitempty"`
+	Rollup    map[string]time.Duration `yaml:"rollup,omitempty"`
+}
+
+type retentionPolicy struct {
+	table     string
+	column    string
+	maxAge    time.Duration
+	batchSize int
+	moveTable string
+	driver    common.ReferenceType
+	partition *Topic
+}
+
+// batchSelecter database handler executing statements with parameters,
+// implemented by the flynn handler
+type batchSelecter interface {
+	BatchSelectFct(search *common.Query, f common.ResultFunction) error
+}
+
+func (topic *Topic) checkRetention() error {
+	r := topic.Retention
+	if r.MaxAge == 0 && len(r.Rollup) == 0 {
+		return fmt.Errorf("retention of topic '%s' needs maxAge or rollup", topic.Name)
+	}
+	if topic.Partition != nil && r.MoveTable != "" {
+		return fmt.Errorf("retention of partitioned topic '%s' cannot move rows", topic.Name)
+	}
+	for p := range r.Rollup {
+		if topic.Rollup == nil || !slices.Contains(topic.Rollup.Periods, p) {
+			return fmt.Errorf("retention of topic '%s' references unknown rollup period '%s'", topic.Name, p)
+		}
+	}
+	return nil
+}
+
+// retentionPolicies list of policies of the store table and the rollup tables
+func (topic *Topic) retentionPolicies() []*retentionPolicy {
+	r := topic.Retention
+	batchSize := r.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultRetentionBatchSize
+	}
+	policies := make([]*retentionPolicy, 0)
+	if r.MaxAge > 0 {
+		column := r.Column
+		if column == "" {
+			column = topic.storeTimeColumn()
+		}
+		p := &retentionPolicy{table: topic.StoreTablename, column: column, maxAge: r.MaxAge,
+			batchSize: batchSize, moveTable: r.MoveTable, driver: topic.service.driver}
+		if topic.Partition != nil {
+			// whole partitions are dropped
+			p.partition = topic
+		}
+		policies = append(policies, p)
+	}
+	for _, p := range rollupPeriods {
+		if age, ok := r.Rollup[p]; ok {
+			policies = append(policies, &retentionPolicy{table: topic.rollupTable(p),
+				column: periodStartColumn, maxAge: age, batchSize: batchSize, driver: topic.service.driver})
+		}
+	}
+	return policies
+}
+
+func (p *retentionPolicy) search(id DatabaseClient, cutoff time.Time) string {
+	return fmt.Sprintf("%s < '%s'", p.column, sqlTime(id, cutoff, sqlTimeLayout))
+}
+
+// count number of rows older than the cutoff
+func (p *retentionPolicy) count(id DatabaseClient, cutoff time.Time) (int64, error) {
+	query := &common.Query{
+		TableName: p.table,
+		Fields:    []string{"COUNT(*)"},
+	}
+	if p.column != "" {
+		query.Search = p.search(id, cutoff)
+	}
+	count := int64(0)
+	_, err := id.Query(query, func(search *common.Query, result *common.Result) error {
+		f, _ := toFloat64(result.Rows[0])
+		count = int64(f)
+		return nil
+	})
+	return count, err
+}
+
+// apply delete or move rows older than the cutoff in batches of the
+// oldest rows to keep transactions and locks small
+func (p *retentionPolicy) apply(id DatabaseClient, cutoff time.Time) (int64, error) {
+	if p.moveTable != "" {
+		err := id.Batch(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s AS SELECT * FROM %s WHERE 1=0",
+			p.moveTable, p.table))
+		if err != nil {
+			return 0, err
+		}
+	}
+	total := int64(0)
+	for {
+		var last time.Time
+		query := &common.Query{
+			TableName: p.table,
+			Fields:    []string{p.column},
+			Search:    p.search(id, cutoff),
+			Order:     []string{p.column + ":ASC"},
+			Limit:     strconv.Itoa(p.batchSize),
+		}
+		_, err := id.Query(query, func(search *common.Query, result *common.Result) error {
+			t, ok := result.Rows[0].(time.Time)
+			if !ok {
+				return fmt.Errorf("column %s is not a time stamp: %T", p.column, result.Rows[0])
+			}
+			last = t
+			return nil
+		})
+		if err != nil {
+			return total, err
+		}
+		if last.IsZero() {
+			return total, nil
+		}
+		n, err := p.remove(id, last)
+		if err != nil {
+			return total, err
+		}
+		total += n
+		log.Log.Debugf("Retention removed %d rows of %s until %v", n, p.table, last)
+		if n == 0 {
+			return total, nil
+		}
+	}
+}
+
+// remove delete the rows until the last time stamp of the batch. Moved
+// rows are copied and deleted in one transaction. The time stamp is bound
+// as parameter to keep sub-second precision.
+func (p *retentionPolicy) remove(id DatabaseClient, last time.Time) (int64, error) {
+	if db, ok := id.(*sqliteDB); ok {
+		return db.removeRows(p.table, p.moveTable, p.column, last)
+	}
+	selecter, ok := id.(batchSelecter)
+	if !ok || p.driver != common.PostgresType {
+		if p.moveTable != "" {
+			return 0, fmt.Errorf("moving rows needs Postgres or SQLite")
+		}
+		criteria := fmt.Sprintf("%s <= '%s'", p.column, last.Format(sqlPreciseTimeLayout))
+		return id.Delete(p.table, &common.Entries{Criteria: criteria})
+	}
+	statement := fmt.Sprintf("WITH removed AS (DELETE FROM %s WHERE %s <= $1 RETURNING *) SELECT COUNT(*) FROM removed",
+		p.table, p.column)
+	if p.moveTable != "" {
+		statement = fmt.Sprintf("WITH removed AS (DELETE FROM %s WHERE %s <= $1 RETURNING *), "+
+			"moved AS (INSERT INTO %s SELECT * FROM removed) SELECT COUNT(*) FROM removed",
+			p.table, p.column, p.moveTable)
+	}
+	count := int64(0)
+	query := &common.Query{Search: statement, Parameters: []any{last}}
+	err := selecter.BatchSelectFct(query, func(search *common.Query, result *common.Result) error {
+		f, _ := toFloat64(result.Rows[0])
+		count = int64(f)
+		return nil
+	})
+	return count, err
+}
+
+// ApplyRetention apply all retention policies once. With dryRun only the
+// number of rows each policy would remove is reported.
+func (s *Service) ApplyRetention(dryRun bool) error {
+	err := s.openHandler(&s.retentionDB)
+	if err != nil {
+		return err
+	}
+	id := s.retentionDB
+	now := time.Now()
+	for _, topic := range s.config.Mapping.Topic {
+		if topic.Retention == nil {
+			continue
+		}
+		for _, p := range topic.retentionPolicies() {
+			cutoff := now.Add(-p.maxAge)
+			if p.partition != nil {
+				_, err := p.partition.dropPartitions(id, cutoff, dryRun)
+				if err != nil {
+					return fmt.Errorf("retention of %s: %v", p.table, err)
+				}
+				continue
+			}
+			if dryRun {
+				count, err := p.count(id, cutoff)
+				if err != nil {
+					return fmt.Errorf("retention count of %s: %v", p.table, err)
+				}
+				services.ServerMessage("Retention of %s would remove %d rows older than %s",
+					p.table, count, cutoff.Format(layout))
+				continue
+			}
+			count, err := p.apply(id, cutoff)
+			if err != nil {
+				return fmt.Errorf("retention of %s: %v", p.table, err)
+			}
+			if count > 0 {
+				services.ServerMessage("Retention of %s removed %d rows older than %s",
+					p.table, count, cutoff.Format(layout))
+			}
+		}
+	}
+	return nil
+}
+
+// ApplyRetention apply all retention policies of the default service once
+func ApplyRetention(dryRun bool) error {
+	return defaultService.ApplyRetention(dryRun)
+}
+
+// loopRetention periodically apply the retention policies
+func (s *Service) loopRetention() {
+	for {
+		err := s.ApplyRetention(false)
+		if err != nil {
+			log.Log.Errorf("Error applying retention: %v", err)
+		}
+		select {
+		case <-s.done:
+			return
+		case <-time.After(retentionInterval):
+		}
+	}
+}
@@ -0,0 +1,306 @@
+/*
+* Copyright 2023-2025 Thorsten A. Knieling
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*    http://www.apache.org/licenses/LICENSE-2.0
+*
+ */
+
+package mqtt2db
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/tknie/flynn/common"
+	"github.com/tknie/log"
+	"github.com/tknie/services"
+)
+
+const (
+	sqlTimeLayout        = "2006-01-02 15:04:05"
+	sqlPreciseTimeLayout = "2006-01-02 15:04:05.999999"
+)
+
+const (
+	periodStartColumn = "period_start"
+	rowCountColumn    = "row_count"
+)
+
+var rollupPeriods = []string{"hour", "day", "month"}
+
+// Rollup rollup tables of a topic. For each period a table named
+// '<storeTablename>_<period>' contains sums, averages, minima and maxima of
+// the configured columns.
+type Rollup struct {
+	Periods    []string `yaml:"periods"`
+	TimeColumn string   `yaml:"timeColumn,omitempty"`
+	Sum        []string `yaml:"sum,omitempty"`
+	Avg        []string `yaml:"avg,omitempty"`
+	Min        []string `yaml:"min,omitempty"`
+	Max        []string `yaml:"max,omitempty"`
+}
+
+type rollupState struct {
+	lock    sync.Mutex
+	dirty   map[string]map[time.Time]bool
+	created map[string]bool
+}
+
+func (topic *Topic) checkRollup() error {
+	r := topic.Rollup
+	if len(r.Periods) == 0 {
+		return fmt.Errorf("rollup periods missing for topic '%s'", topic.Name)
+	}
+	for _, p := range r.Periods {
+		if !slices.Contains(rollupPeriods, p) {
+			return fmt.Errorf("unknown rollup period '%s' for topic '%s'", p, topic.Name)
+		}
+	}
+	if topic.rollupTimeColumn() == "" {
+		return fmt.Errorf("rollup time column missing for topic '%s'", topic.Name)
+	}
+	topic.rollup = &rollupState{dirty: make(map[string]map[time.Time]bool), created: make(map[string]bool)}
+	return nil
+}
+
+func (topic *Topic) rollupTimeColumn() string {
+	if topic.Rollup.TimeColumn != "" {
+		return topic.Rollup.TimeColumn
+	}
+	return topic.timeColumn()
+}
+
+func (topic *Topic) rollupTable(period string) string {
+	return topic.StoreTablename + "_" + period
+}
+
+// periodStart calculate start and end of the period containing the time
+func periodStart(period string, t time.Time) (time.Time, time.Time) {
+	switch period {
+	case "hour":
+		start := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+		return start, start.Add(time.Hour)
+	case "day":
+		start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+		return start, start.AddDate(0, 0, 1)
+	default:
+		start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+		return start, start.AddDate(0, 1, 0)
+	}
+}
+
+// rollupFields list of aggregate SQL expressions and column names
+func (topic *Topic) rollupFields() ([]string, []string) {
+	fields := []string{"COUNT(*)"}
+	names := []string{rowCountColumn}
+	r := topic.Rollup
+	for _, fct := range []struct {
+		name    string
+		suffix  string
+		columns []string
+	}{{"SUM", "_sum", r.Sum}, {"AVG", "_avg", r.Avg}, {"MIN", "_min", r.Min}, {"MAX", "_max", r.Max}} {
+		for _, col := range fct.columns {
+			fields = append(fields, fct.name+"("+col+")")
+			names = append(names, col+fct.suffix)
+		}
+	}
+	return fields, names
+}
+
+func (topic *Topic) rollupColumns() []*common.Column {
+	columns := []*common.Column{{Name: periodStartColumn, DataType: common.CurrentTimestamp},
+		{Name: rowCountColumn, DataType: common.BigInteger}}
+	_, names := topic.rollupFields()
+	for _, name := range names[1:] {
+		columns = append(columns, &common.Column{Name: name, DataType: common.Decimal,
+			Length: defaultDecimalLength, Digits: defaultDecimalDigits})
+	}
+	return columns
+}
+
+// markRollup mark the periods containing the stored entry to be updated
+func (topic *Topic) markRollup(e map[string]interface{}) {
+	if topic.Rollup == nil || topic.rollup == nil {
+		return
+	}
+	t, ok := e[topic.rollupTimeColumn()].(time.Time)
+	if !ok {
+		t = time.Now()
+	}
+	state := topic.rollup
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	for _, p := range topic.Rollup.Periods {
+		start, _ := periodStart(p, t)
+		if state.dirty[p] == nil {
+			state.dirty[p] = make(map[time.Time]bool)
+		}
+		state.dirty[p][start] = true
+	}
+}
+
+// flushRollup update all marked periods of the rollup tables
+func (topic *Topic) flushRollup() {
+	if topic.rollup == nil {
+		return
+	}
+	state := topic.rollup
+	state.lock.Lock()
+	dirty := state.dirty
+	state.dirty = make(map[string]map[time.Time]bool)
+	state.lock.Unlock()
+	for p, starts := range dirty {
+		for start := range starts {
+			err := topic.updateRollup(topic.service.rollupDB, p, start)
+			if err != nil {
+				log.Log.Errorf("Error updating rollup %s: %v", topic.rollupTable(p), err)
+			}
+		}
+	}
+}
+
+// updateRollup recalculate the period of the rollup table out of the
+// stored rows
+func (topic *Topic) updateRollup(id DatabaseClient, period string, start time.Time) error {
+	table := topic.rollupTable(period)
+	if !topic.rollup.created[table] {
+		_, err := id.CreateTableIfNotExists(table, topic.rollupColumns())
+		if err != nil {
+			return err
+		}
+		topic.rollup.created[table] = true
+	}
+	start, end := periodStart(period, start)
+	fields, names := topic.rollupFields()
+	tc := topic.rollupTimeColumn()
+	query := &common.Query{
+		TableName: topic.tableFor(start),
+		Fields:    fields,
+		Search: fmt.Sprintf("%s >= '%s' AND %s < '%s'", tc, sqlTime(id, start, sqlTimeLayout),
+			tc, sqlTime(id, end, sqlTimeLayout)),
+	}
+	var values []any
+	_, err := id.Query(query, func(search *common.Query, result *common.Result) error {
+		values = slices.Clone(result.Rows)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	_, err = id.Delete(table, &common.Entries{Criteria: fmt.Sprintf("%s = '%s'",
+		periodStartColumn, sqlTime(id, start, sqlTimeLayout))})
+	if err != nil {
+		return err
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	if count, ok := toFloat64(values[0]); !ok || count == 0 {
+		return nil
+	}
+	row := map[string]interface{}{periodStartColumn: start}
+	for i, name := range names {
+		if f, ok := toFloat64(values[i]); ok {
+			if i == 0 {
+				row[name] = int64(f)
+			} else {
+				row[name] = f
+			}
+		}
+	}
+	keys := append([]string{periodStartColumn}, names...)
+	insert := &common.Entries{Fields: keys, Update: keys, Values: [][]any{{row}}}
+	_, err = id.Insert(table, insert)
+	return err
+}
+
+// loopRollup periodically update the marked periods of all rollup tables
+func (s *Service) loopRollup() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-time.After(time.Minute):
+			s.flushRollups()
+		}
+	}
+}
+
+// flushRollups update the marked periods of all rollup tables
+func (s *Service) flushRollups() {
+	for _, topic := range s.config.Mapping.Topic {
+		if topic.Rollup != nil {
+			topic.flushRollup()
+		}
+	}
+}
+
+// BackfillRollup build the rollup tables of the topic out of the stored
+// history
+func (s *Service) BackfillRollup(name string) error {
+	topic := s.findTopic(name)
+	if topic == nil {
+		return fmt.Errorf("topic '%s' not found", name)
+	}
+	if topic.Rollup == nil {
+		return fmt.Errorf("topic '%s' has no rollup defined", name)
+	}
+	err := s.openHandler(&s.rollupDB)
+	if err != nil {
+		return err
+	}
+	tables, err := topic.queryTables(s.rollupDB)
+	if err != nil {
+		return err
+	}
+	tc := topic.rollupTimeColumn()
+	var first, last time.Time
+	for _, table := range tables {
+		query := &common.Query{
+			TableName: table,
+			Fields:    []string{"MIN(" + tc + ")", "MAX(" + tc + ")"},
+		}
+		_, err = s.rollupDB.Query(query, func(search *common.Query, result *common.Result) error {
+			if t, ok := result.Rows[0].(time.Time); ok && (first.IsZero() || t.Before(first)) {
+				first = t
+			}
+			if t, ok := result.Rows[1].(time.Time); ok && t.After(last) {
+				last = t
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if first.IsZero() {
+		services.ServerMessage("No rows in table %s", topic.StoreTablename)
+		return nil
+	}
+	for _, p := range topic.Rollup.Periods {
+		services.ServerMessage("Backfill rollup %s from %s to %s", topic.rollupTable(p),
+			first.Format(layout), last.Format(layout))
+		counter := 0
+		for start, _ := periodStart(p, first); !start.After(last); {
+			err = topic.updateRollup(s.rollupDB, p, start)
+			if err != nil {
+				return err
+			}
+			_, start = periodStart(p, start)
+			counter++
+		}
+		services.ServerMessage("Backfill rollup %s done, %d periods", topic.rollupTable(p), counter)
+	}
+	return nil
+}
+
+// BackfillRollup build the rollup tables of the topic of the default service
+func BackfillRollup(name string) error {
+	return defaultService.BackfillRollup(name)
+}
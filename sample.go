@@ -0,0 +1,119 @@
+/*
+* Copyright 2023-2025 Thorsten A. Knieling
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*    http://www.apache.org/licenses/LICENSE-2.0
+*
+ */
+
+package mqtt2db
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/tknie/log"
+)
+
+// Sample downsampling policy of a topic. All defined policies must accept
+// a message to be stored.
+type Sample struct {
+	Every    uint64        `yaml:"every,omitempty"`
+	Interval time.Duration `yaml:"interval,omitempty"`
+	Deadband []Deadband    `yaml:"deadband,omitempty"`
+}
+
+// Deadband accept the message only if the value of the field changed by
+// more than delta since the last stored message
+type Deadband struct {
+	Field string  `yaml:"field"`
+	Delta float64 `yaml:"delta,omitempty"`
+}
+
+type sampleState struct {
+	count      uint64
+	lastStored time.Time
+	lastValues map[string]interface{}
+}
+
+// initFilter check filter conditions and sample policy of the topic
+func (topic *Topic) initFilter() error {
+	for _, cond := range topic.Filter {
+		if cond.Field == "" {
+			return fmt.Errorf("filter condition without field for topic '%s'", topic.Name)
+		}
+		if err := cond.check(); err != nil {
+			return fmt.Errorf("filter %v for topic '%s'", err, topic.Name)
+		}
+	}
+	if topic.Sample != nil {
+		for _, d := range topic.Sample.Deadband {
+			if d.Field == "" {
+				return fmt.Errorf("deadband without field for topic '%s'", topic.Name)
+			}
+		}
+	}
+	topic.sample = &sampleState{lastValues: make(map[string]interface{})}
+	return nil
+}
+
+// accept apply filter and sample policy on the message. Returns false if the
+// message is ignored.
+func (topic *Topic) accept(x map[string]interface{}, received time.Time) bool {
+	for _, cond := range topic.Filter {
+		v, ok := sourceValue(x, cond.Field)
+		if !cond.match(v, ok) {
+			log.Log.Debugf("Message of topic %s filtered by %s %s", topic.Name, cond.Field, cond.Op)
+			return false
+		}
+	}
+	sample := topic.Sample
+	if sample == nil {
+		return true
+	}
+	state := topic.sample
+	if state == nil {
+		state = &sampleState{lastValues: make(map[string]interface{})}
+		topic.sample = state
+	}
+	state.count++
+	if sample.Every > 1 && (state.count-1)%sample.Every != 0 {
+		return false
+	}
+	if sample.Interval > 0 && !state.lastStored.IsZero() &&
+		received.Sub(state.lastStored) < sample.Interval {
+		return false
+	}
+	if len(sample.Deadband) > 0 && len(state.lastValues) > 0 {
+		changed := false
+		for _, d := range sample.Deadband {
+			v, _ := sourceValue(x, d.Field)
+			if d.changed(state.lastValues[d.Field], v) {
+				changed = true
+				break
+			}
+		}
+		if !changed {
+			return false
+		}
+	}
+	state.lastStored = received
+	for _, d := range sample.Deadband {
+		v, _ := sourceValue(x, d.Field)
+		state.lastValues[d.Field] = v
+	}
+	return true
+}
+
+func (d *Deadband) changed(last, current interface{}) bool {
+	l, lErr := convertFloat64(compareType, last)
+	c, cErr := convertFloat64(compareType, current)
+	if lErr != nil || cErr != nil {
+		return fmt.Sprintf("%v", last) != fmt.Sprintf("%v", current)
+	}
+	return math.Abs(c.(float64)-l.(float64)) > d.Delta
+}
@@ -0,0 +1,384 @@
+/*
+* Copyright 2023-2025 Thorsten A. Knieling
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*    http://www.apache.org/licenses/LICENSE-2.0
+*
+ */
+
+package mqtt2db
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/tknie/flynn"
+	"github.com/tknie/flynn/common"
+	"github.com/tknie/log"
+	"github.com/tknie/services"
+)
+
+// DatabaseClient database operations used by the service. It is
+// implemented by the flynn handler common.RegDbID.
+type DatabaseClient interface {
+	Query(query *common.Query, f common.ResultFunction) (*common.Result, error)
+	CreateTableIfNotExists(tableName string, columns any) (common.CreateStatus, error)
+	DeleteTable(tableName string) error
+	Batch(batch string) error
+	Ping() error
+	Insert(name string, insert *common.Entries) ([][]any, error)
+	Update(name string, insert *common.Entries) ([][]any, int64, error)
+	Delete(name string, remove *common.Entries) (int64, error)
+	GetTableColumn(tableName string) ([]string, error)
+	Tables() ([]string, error)
+	FreeHandler() error
+}
+
+// MQTTClient MQTT operations used by the service to publish rejected
+// messages and alerts. It is implemented by the paho client.
+type MQTTClient interface {
+	Publish(ctx context.Context, p *paho.Publish) (*paho.PublishResponse, error)
+}
+
+// Hooks optional callbacks of the service
+type Hooks struct {
+	// OnMessage is called for each received message
+	OnMessage func(topic string, payload []byte)
+	// OnEntry is called with the mapped entry before it is stored, the
+	// entry is skipped if false is returned
+	OnEntry func(topic *Topic, entry map[string]interface{}) bool
+	// OnStored is called after the entry is stored
+	OnStored func(topic *Topic, entry map[string]interface{})
+	// OnReject is called for each rejected message
+	OnReject func(topic *Topic, payload []byte, reason error)
+	// OnError is called if storing fails. Without this hook the process
+	// is stopped.
+	OnError func(err error)
+}
+
+// ServiceConfig configuration of a service. If Database or MQTT is set, the
+// client is used instead of connecting to the database URL or the MQTT
+// server of the mapping. With an injected MQTT client the messages are
+// passed by HandleMessage. Sinks adds storage backends selectable by the
+// topics or replaces the database sink.
+type ServiceConfig struct {
+	Mapping     *Mqtt2db
+	Qos         int
+	ClientID    string
+	Create      bool
+	MaxTries    int
+	LoopSeconds int
+	Database    DatabaseClient
+	Driver      common.ReferenceType
+	MQTT        MQTTClient
+	Sinks       map[string]Sink
+	Hooks       Hooks
+}
+
+// Service receives the MQTT messages of all topics of the mapping and
+// stores them into the database. Several services can run in one process.
+type Service struct {
+	config       *ServiceConfig
+	db           DatabaseClient
+	driver       common.ReferenceType
+	mqtt         MQTTClient
+	client       *paho.Client
+	mqttLock     sync.Mutex
+	reconnect    chan struct{}
+	messages     chan *paho.Publish
+	done         chan struct{}
+	loopDone     chan struct{}
+	stopOnce     sync.Once
+	counter      atomic.Uint64
+	storeLock    sync.Mutex
+	counters     counterStore
+	rollupDB     DatabaseClient
+	retentionDB  DatabaseClient
+	release      []func()
+	rejectLock   sync.Mutex
+	rejectTables map[string]bool
+	metrics      serviceMetrics
+	sinkLock     sync.Mutex
+	sinks        map[string]Sink
+	httpServer   *http.Server
+	startTime    time.Time
+}
+
+// defaultService service used by the command line functions
+var defaultService = newService(&ServiceConfig{Mapping: &Mqtt2db{}})
+
+func newService(config *ServiceConfig) *Service {
+	s := &Service{config: config, db: config.Database, driver: config.Driver, mqtt: config.MQTT,
+		done: make(chan struct{}), reconnect: make(chan struct{}, 1), rejectTables: make(map[string]bool), startTime: time.Now()}
+	s.counters.states = make(map[string]*counterState)
+	s.metrics.topics = make(map[string]*topicMetrics)
+	s.sinks = make(map[string]Sink)
+	for name, sink := range config.Sinks {
+		s.sinks[name] = sink
+	}
+	return s
+}
+
+// NewService create a service out of the configuration. The topic
+// mappings are checked and bound to the service.
+func NewService(config *ServiceConfig) (*Service, error) {
+	if config.Mapping == nil {
+		return nil, fmt.Errorf("mapping missing")
+	}
+	if config.Database == nil && config.Mapping.Database.Url == "" && config.Mapping.usesDatabase() {
+		return nil, fmt.Errorf("database URL missing")
+	}
+	s := newService(config)
+	err := s.setMapping(config.Mapping)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// setMapping check the topics of the mapping and bind them to the service
+func (s *Service) setMapping(m *Mqtt2db) error {
+	err := s.checkSinks(m)
+	if err != nil {
+		return err
+	}
+	for _, topic := range m.Topic {
+		topic.service = s
+		err = topic.initMapping()
+		if err != nil {
+			return err
+		}
+	}
+	s.config.Mapping = m
+	return nil
+}
+
+// Mapping current mapping of the service
+func (s *Service) Mapping() *Mqtt2db {
+	return s.config.Mapping
+}
+
+// Start connect to the database and the MQTT server, subscribe all topics
+// and process the received messages in the background. The service is
+// stopped if the context is cancelled. A stopped service cannot be started
+// again, a new service is created instead.
+func (s *Service) Start(ctx context.Context) error {
+	select {
+	case <-s.done:
+		return fmt.Errorf("service stopped")
+	default:
+	}
+	if s.messages != nil {
+		return fmt.Errorf("service already started")
+	}
+	s.messages = make(chan *paho.Publish, messageQueueSize)
+	db, mqtt, released := s.db, s.mqtt, len(s.release)
+	err := s.initDatabase()
+	if err != nil {
+		s.abortStart(db, mqtt, released)
+		return err
+	}
+	s.metrics.databaseUp.Store(true)
+	s.startHTTP()
+	if s.mqtt == nil {
+		err = s.connectMQTT(ctx)
+		if err != nil {
+			s.abortStart(db, mqtt, released)
+			return err
+		}
+		go s.loopReconnectMQTT()
+	} else {
+		s.metrics.mqttConnected.Store(true)
+		s.metrics.mqttSubscribed.Store(true)
+	}
+	topicMap := make(map[string]*Topic)
+	for _, topic := range s.config.Mapping.Topic {
+		topicMap[topic.Name] = topic
+	}
+	if s.httpServer != nil {
+		go s.loopDatabasePing()
+	}
+	s.loopDone = make(chan struct{})
+	go s.loopIncomingMessages(topicMap)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Stop()
+		case <-s.done:
+		}
+	}()
+	return nil
+}
+
+// abortStart release everything acquired by a failed Start, the injected
+// database and MQTT client and the handlers opened before are kept. Start
+// can be called again.
+func (s *Service) abortStart(db DatabaseClient, mqtt MQTTClient, released int) {
+	if s.httpServer != nil {
+		s.httpServer.Close()
+		s.httpServer = nil
+	}
+	s.disconnectMQTT()
+	for _, release := range s.release[released:] {
+		release()
+	}
+	s.release = s.release[:released]
+	s.db = db
+	s.mqttLock.Lock()
+	s.mqtt = mqtt
+	s.mqttLock.Unlock()
+	s.metrics.databaseUp.Store(false)
+	s.metrics.mqttConnected.Store(false)
+	s.metrics.mqttSubscribed.Store(false)
+	s.messages = nil
+}
+
+// HandleMessage pass a received message to the service, used together
+// with an injected MQTT client
+func (s *Service) HandleMessage(topic string, payload []byte) error {
+	if s.messages == nil {
+		return fmt.Errorf("service not started")
+	}
+	// the queue may still have room after stop
+	select {
+	case <-s.done:
+		return fmt.Errorf("service stopped")
+	default:
+	}
+	select {
+	case <-s.done:
+		return fmt.Errorf("service stopped")
+	case s.messages <- &paho.Publish{Topic: topic, Payload: payload}:
+		return nil
+	}
+}
+
+// Stop stop receiving messages, store open aggregation windows, counter
+// states and rollups, disconnect from MQTT and release the database
+// handlers opened by the service. The service cannot be started again.
+func (s *Service) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.done)
+		if s.loopDone != nil {
+			<-s.loopDone
+		}
+		s.FlushAggregates()
+		s.SaveCounterState()
+		if s.rollupDB != nil {
+			s.flushRollups()
+		}
+		s.closeSinks()
+		s.disconnectMQTT()
+		if s.httpServer != nil {
+			s.httpServer.Close()
+		}
+		for _, release := range s.release {
+			release()
+		}
+		s.release = nil
+	})
+}
+
+// reference database reference and password of the mapping URL
+func (s *Service) reference() (*common.Reference, string, error) {
+	database := s.config.Mapping.Database
+	dbRef, password, err := common.NewReference(database.Url)
+	if err != nil {
+		return nil, "", fmt.Errorf("database URL incorrect: %v", err)
+	}
+	if password == "" {
+		password = os.Getenv("MQTT_STORE_PASS")
+	}
+	if dbRef.User == "" {
+		dbRef.User = os.Getenv("MQTT_STORE_USER")
+		if dbRef.User == "" {
+			dbRef.User = database.Username
+		}
+	}
+	if dbRef.User == "" {
+		dbRef.User = "admin"
+	}
+	dbRef.Options = append(dbRef.Options, fmt.Sprintf("application_name=MQTT2db %s", BuildVersion))
+	return dbRef, password, nil
+}
+
+// handler open an additional database handler, the returned function
+// releases it. An injected database client is shared.
+func (s *Service) handler() (DatabaseClient, func(), error) {
+	if s.config.Database != nil {
+		return s.config.Database, func() {}, nil
+	}
+	if path, ok := sqlitePath(s.config.Mapping.Database.Url); ok {
+		id, err := openSQLite(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return id, func() { id.FreeHandler() }, nil
+	}
+	dbRef, password, err := s.reference()
+	if err != nil {
+		return nil, nil, err
+	}
+	id, err := flynn.Handler(dbRef, password)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.driver = dbRef.Driver
+	return id, func() { id.FreeHandler() }, nil
+}
+
+// openHandler open the database handler used by background jobs if not
+// already done
+func (s *Service) openHandler(id *DatabaseClient) error {
+	if *id != nil {
+		return nil
+	}
+	nid, release, err := s.handler()
+	if err != nil {
+		return err
+	}
+	s.release = append(s.release, release)
+	*id = nid
+	return nil
+}
+
+// publish publish the payload to the MQTT topic if a MQTT client is
+// available
+func (s *Service) publish(topic string, payload []byte) error {
+	client := s.mqttClient()
+	if client == nil {
+		return nil
+	}
+	_, err := client.Publish(context.Background(), &paho.Publish{Topic: topic, Payload: payload})
+	return err
+}
+
+// fail report an error the service cannot recover from. Without error
+// hook the process is stopped.
+func (s *Service) fail(err error) {
+	if s.config.Hooks.OnError != nil {
+		s.config.Hooks.OnError(err)
+		return
+	}
+	services.ServerMessage("Fatal error: %v", err)
+	log.Log.Fatal(err)
+}
+
+// findTopic search topic by topic name or store table name
+func (s *Service) findTopic(name string) *Topic {
+	for _, topic := range s.config.Mapping.Topic {
+		if topic.Name == name || topic.StoreTablename == name {
+			return topic
+		}
+	}
+	return nil
+}
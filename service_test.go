@@ -0,0 +1,243 @@
+/*
+* Copyright 2023-2025 Thorsten A. Knieling
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*    http://www.apache.org/licenses/LICENSE-2.0
+*
+ */
+
+package mqtt2db
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/tknie/flynn/common"
+)
+
+// fakeDatabase in-memory DatabaseClient recording created tables and
+// inserted entries
+type fakeDatabase struct {
+	lock    sync.Mutex
+	tables  []string
+	inserts map[string][]map[string]interface{}
+	freed   bool
+}
+
+func (db *fakeDatabase) Query(query *common.Query, f common.ResultFunction) (*common.Result, error) {
+	return &common.Result{}, nil
+}
+
+func (db *fakeDatabase) CreateTableIfNotExists(tableName string, columns any) (common.CreateStatus, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.tables = append(db.tables, tableName)
+	return common.CreateCreated, nil
+}
+
+func (db *fakeDatabase) DeleteTable(tableName string) error { return nil }
+
+func (db *fakeDatabase) Batch(batch string) error { return nil }
+
+func (db *fakeDatabase) Ping() error { return nil }
+
+func (db *fakeDatabase) Insert(name string, insert *common.Entries) ([][]any, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	for _, v := range insert.Values {
+		db.inserts[name] = append(db.inserts[name], v[0].(map[string]interface{}))
+	}
+	return nil, nil
+}
+
+func (db *fakeDatabase) Update(name string, insert *common.Entries) ([][]any, int64, error) {
+	return nil, 0, nil
+}
+
+func (db *fakeDatabase) Delete(name string, remove *common.Entries) (int64, error) { return 0, nil }
+
+func (db *fakeDatabase) GetTableColumn(tableName string) ([]string, error) { return nil, nil }
+
+func (db *fakeDatabase) Tables() ([]string, error) { return nil, nil }
+
+func (db *fakeDatabase) FreeHandler() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.freed = true
+	return nil
+}
+
+func (db *fakeDatabase) entries(table string) []map[string]interface{} {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return append([]map[string]interface{}{}, db.inserts[table]...)
+}
+
+// fakeMQTT MQTTClient recording the published messages
+type fakeMQTT struct {
+	lock      sync.Mutex
+	published []*paho.Publish
+}
+
+func (c *fakeMQTT) Publish(ctx context.Context, p *paho.Publish) (*paho.PublishResponse, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.published = append(c.published, p)
+	return &paho.PublishResponse{}, nil
+}
+
+func (c *fakeMQTT) messages() []*paho.Publish {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]*paho.Publish{}, c.published...)
+}
+
+// fakeSink Sink recording the written entries
+type fakeSink struct {
+	lock    sync.Mutex
+	entries []map[string]interface{}
+	flushed bool
+	closed  bool
+}
+
+func (sink *fakeSink) Write(topic *Topic, entries []map[string]interface{}) error {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	sink.entries = append(sink.entries, entries...)
+	return nil
+}
+
+func (sink *fakeSink) Flush() error {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	sink.flushed = true
+	return nil
+}
+
+func (sink *fakeSink) Close() error {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	sink.closed = true
+	return nil
+}
+
+func (sink *fakeSink) Health() error { return nil }
+
+func TestServiceLifecycle(t *testing.T) {
+	db := &fakeDatabase{inserts: make(map[string][]map[string]interface{})}
+	client := &fakeMQTT{}
+	extern := &fakeSink{}
+	stored := make(chan map[string]interface{}, 10)
+	rejected := make(chan error, 10)
+	mapping := &Mqtt2db{Reject: &Reject{Topic: "mqtt2db/reject"},
+		Topic: []*Topic{{Name: "home/+/power", StoreTablename: "power", Sinks: []string{DatabaseSink, "extern"},
+			Mapping: Mapping{{Source: "Power", Destination: "Power", Type: "float64", Required: true}}}}}
+	s, err := NewService(&ServiceConfig{Mapping: mapping, Create: true, Database: db, MQTT: client,
+		Sinks: map[string]Sink{"extern": extern},
+		Hooks: Hooks{
+			OnStored: func(topic *Topic, entry map[string]interface{}) { stored <- entry },
+			OnReject: func(topic *Topic, payload []byte, reason error) { rejected <- reason },
+			OnError:  func(err error) { t.Errorf("unexpected error: %v", err) },
+		}})
+	if err != nil {
+		t.Fatalf("NewService: %v", err)
+	}
+	if err = s.HandleMessage("home/meter/power", []byte(`{"Power":1}`)); err == nil {
+		t.Errorf("message accepted before start")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err = s.Start(ctx); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if err = s.Start(ctx); err == nil {
+		t.Errorf("second start not rejected")
+	}
+	if len(db.tables) != 1 || db.tables[0] != "power" {
+		t.Errorf("created tables %v, want [power]", db.tables)
+	}
+
+	if err = s.HandleMessage("home/meter/power", []byte(`{"Power":12.5}`)); err != nil {
+		t.Fatalf("HandleMessage: %v", err)
+	}
+	select {
+	case e := <-stored:
+		if e["Power"] != 12.5 {
+			t.Errorf("stored entry %v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("entry not stored")
+	}
+	entries := db.entries("power")
+	if len(entries) != 1 || entries[0]["Power"] != 12.5 {
+		t.Errorf("inserted entries %v", entries)
+	}
+
+	if err = s.HandleMessage("home/meter/power", []byte(`{"Voltage":230}`)); err != nil {
+		t.Fatalf("HandleMessage: %v", err)
+	}
+	select {
+	case <-rejected:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("message not rejected")
+	}
+	// the reject entry is published after the reject hook
+	published := client.messages()
+	for i := 0; i < 100 && len(published) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		published = client.messages()
+	}
+	if len(published) != 1 || published[0].Topic != "mqtt2db/reject" {
+		t.Fatalf("published %v, want reject entry", published)
+	}
+	var entry rejectEntry
+	if err = json.Unmarshal(published[0].Payload, &entry); err != nil || entry.Topic != "home/+/power" {
+		t.Errorf("reject entry %s: %v", published[0].Payload, err)
+	}
+
+	s.Stop()
+	if err = s.HandleMessage("home/meter/power", []byte(`{"Power":1}`)); err == nil {
+		t.Errorf("message accepted after stop")
+	}
+	if err = s.Start(ctx); err == nil {
+		t.Errorf("start after stop not rejected")
+	}
+	if db.freed {
+		t.Errorf("injected database released by stop")
+	}
+	if len(db.entries("power")) != 1 {
+		t.Errorf("entries stored after stop")
+	}
+	if len(extern.entries) != 1 || !extern.flushed || extern.closed {
+		t.Errorf("external sink entries=%v flushed=%v closed=%v, want flushed and not closed",
+			extern.entries, extern.flushed, extern.closed)
+	}
+}
+
+func TestServiceRepublishLoop(t *testing.T) {
+	for _, test := range []struct {
+		topic  string
+		server string
+		valid  bool
+	}{{"home/{table}", "", false}, {"home/{table}", "broker:1883", true}, {"", "", true}} {
+		republish := &Republish{Topic: test.topic}
+		if test.server != "" {
+			republish.Mqtt = &Mqtt{Server: test.server}
+		}
+		mapping := &Mqtt2db{Sinks: []*SinkConfig{{Name: "republish", Republish: republish}},
+			Topic: []*Topic{{Name: "home/#", StoreTablename: "power", Sinks: []string{"republish"},
+				Mapping: Mapping{{Source: "Power", Destination: "Power", Type: "float64"}}}}}
+		_, err := NewService(&ServiceConfig{Mapping: mapping})
+		if (err == nil) != test.valid {
+			t.Errorf("republish topic '%s' server '%s': err=%v, want valid=%v",
+				test.topic, test.server, err, test.valid)
+		}
+	}
+}
@@ -0,0 +1,416 @@
+/*
+* Copyright 2023-2025 Thorsten A. Knieling
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*    http://www.apache.org/licenses/LICENSE-2.0
+*
+ */
+
+package mqtt2db
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tknie/flynn"
+	"github.com/tknie/flynn/common"
+	"github.com/tknie/log"
+)
+
+// DatabaseSink name of the default sink storing into the database of the
+// mapping
+const DatabaseSink = "database"
+
+const sinkFlushInterval = 10 * time.Second
+
+var outputNameReplacer = strings.NewReplacer("/", "_", "+", "_", "#", "_", " ", "_")
+
+// Sink storage backend of the mapped entries
+type Sink interface {
+	// Write store a batch of entries of the topic
+	Write(topic *Topic, entries []map[string]interface{}) error
+	// Flush write buffered entries
+	Flush() error
+	// Close flush buffered entries and release the backend
+	Close() error
+	// Health returns an error if the backend is not available
+	Health() error
+}
+
+// SinkConfig additional storage backend. Topics select the sinks by name,
+// without selection the entries are stored into the database.
+type SinkConfig struct {
+	Name      string     `yaml:"name"`
+	Database  *Database  `yaml:"database,omitempty"`
+	Influx    *Influx    `yaml:"influx,omitempty"`
+	File      *File      `yaml:"file,omitempty"`
+	Republish *Republish `yaml:"republish,omitempty"`
+}
+
+// sqlSink store entries into a SQL database using flynn. The default sink
+// uses the database of the service including partitions, other databases
+// get the store table created on first use.
+type sqlSink struct {
+	service *Service
+	id      DatabaseClient
+	driver  common.ReferenceType
+	lock    sync.Mutex
+	created map[string]bool
+}
+
+func (sink *sqlSink) Write(topic *Topic, entries []map[string]interface{}) error {
+	if topic.StoreTablename == "" {
+		return nil
+	}
+	s := sink.service
+	if sink.id == nil {
+		return s.writeDatabase(topic, entries)
+	}
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	if !sink.created[topic.StoreTablename] {
+		status, err := sink.id.CreateTableIfNotExists(topic.StoreTablename, topic.createColumns())
+		if err != nil {
+			return err
+		}
+		if status == common.CreateCreated {
+			err = topic.initTable(sink.id, sink.driver, topic.StoreTablename)
+			if err != nil {
+				return err
+			}
+		}
+		sink.created[topic.StoreTablename] = true
+	}
+	return insertEntries(sink.id, topic.StoreTablename, entries)
+}
+
+func (sink *sqlSink) Flush() error {
+	return nil
+}
+
+func (sink *sqlSink) Close() error {
+	if sink.id == nil {
+		return nil
+	}
+	return sink.id.FreeHandler()
+}
+
+func (sink *sqlSink) Health() error {
+	if sink.id == nil {
+		if !sink.service.metrics.databaseUp.Load() {
+			return fmt.Errorf("database not reachable")
+		}
+		return nil
+	}
+	return sink.id.Ping()
+}
+
+// newSQLSink open a handler to the database of the sink
+func newSQLSink(s *Service, database *Database) (Sink, error) {
+	if path, ok := sqlitePath(database.Url); ok {
+		id, err := openSQLite(path)
+		if err != nil {
+			return nil, err
+		}
+		return &sqlSink{service: s, id: id, created: make(map[string]bool)}, nil
+	}
+	dbRef, password, err := common.NewReference(database.Url)
+	if err != nil {
+		return nil, fmt.Errorf("database URL incorrect: %v", err)
+	}
+	if dbRef.User == "" {
+		dbRef.User = database.Username
+	}
+	id, err := flynn.Handler(dbRef, password)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlSink{service: s, id: id, driver: dbRef.Driver, created: make(map[string]bool)}, nil
+}
+
+// insertEntries insert the entries. Consecutive entries with the same
+// fields are inserted in one transaction.
+func insertEntries(id DatabaseClient, table string, entries []map[string]interface{}) error {
+	var fields []string
+	values := make([][]any, 0, len(entries))
+	insert := func() error {
+		if len(values) == 0 {
+			return nil
+		}
+		_, err := id.Insert(table, &common.Entries{Fields: fields, Update: fields, Values: values})
+		values = make([][]any, 0, len(entries))
+		return err
+	}
+	for _, e := range entries {
+		keys := sortedKeys(e)
+		if !slices.Equal(keys, fields) {
+			if err := insert(); err != nil {
+				return err
+			}
+			fields = keys
+		}
+		values = append(values, []any{e})
+	}
+	return insert()
+}
+
+// writeDatabase store the entries into the database of the service
+func (s *Service) writeDatabase(topic *Topic, entries []map[string]interface{}) error {
+	if s.db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	s.storeLock.Lock()
+	start := time.Now()
+	var err error
+	for i := 0; i < len(entries) && err == nil; {
+		table := s.storeTable(topic, entries[i])
+		j := i + 1
+		for j < len(entries) && s.storeTable(topic, entries[j]) == table {
+			j++
+		}
+		err = insertEntries(s.db, table, entries[i:j])
+		i = j
+	}
+	s.storeLock.Unlock()
+	if err != nil {
+		s.metrics.databaseUp.Store(false)
+		return err
+	}
+	m := topic.metrics()
+	m.insert.observe(time.Since(start).Seconds())
+	m.stored.Add(uint64(len(entries)))
+	s.metrics.databaseUp.Store(true)
+	return nil
+}
+
+// storeTable table the entry is stored in, the partition is created if
+// not available
+func (s *Service) storeTable(topic *Topic, e map[string]interface{}) string {
+	if topic.Partition == nil {
+		return topic.StoreTablename
+	}
+	t, ok := e[topic.partitionColumn()].(time.Time)
+	if !ok {
+		t = time.Now()
+	}
+	if err := topic.createPartition(s.db, t); err != nil {
+		log.Log.Errorf("Error creating partition: %v", err)
+	}
+	return topic.tableFor(t)
+}
+
+// sink sink of the name, opened on first use
+func (s *Service) sink(name string) (Sink, error) {
+	s.sinkLock.Lock()
+	defer s.sinkLock.Unlock()
+	if sink, ok := s.sinks[name]; ok {
+		return sink, nil
+	}
+	var sink Sink
+	var err error
+	switch config := s.sinkConfig(name); {
+	case name == DatabaseSink:
+		sink = &sqlSink{service: s}
+	case config == nil:
+		return nil, fmt.Errorf("unknown sink '%s'", name)
+	default:
+		sink, err = s.newSink(config)
+		if err != nil {
+			return nil, fmt.Errorf("sink '%s': %v", name, err)
+		}
+	}
+	s.sinks[name] = sink
+	return sink, nil
+}
+
+func (s *Service) newSink(config *SinkConfig) (Sink, error) {
+	switch {
+	case config.Database != nil:
+		return newSQLSink(s, config.Database)
+	case config.Influx != nil:
+		return newInfluxSink(config.Influx)
+	case config.File != nil:
+		return newFileSink(config.File)
+	case config.Republish != nil:
+		return newRepublishSink(s, config.Republish)
+	}
+	return nil, fmt.Errorf("no backend defined")
+}
+
+func (s *Service) sinkConfig(name string) *SinkConfig {
+	for _, config := range s.config.Mapping.Sinks {
+		if config.Name == name {
+			return config
+		}
+	}
+	return nil
+}
+
+// checkSinks check the sink configuration and the sinks selected by the
+// topics
+func (s *Service) checkSinks(m *Mqtt2db) error {
+	names := []string{DatabaseSink}
+	for name := range s.config.Sinks {
+		names = append(names, name)
+	}
+	for _, config := range m.Sinks {
+		if config.Name == "" || slices.Contains(names, config.Name) {
+			return fmt.Errorf("sink name '%s' empty or not unique", config.Name)
+		}
+		names = append(names, config.Name)
+	}
+	for _, topic := range m.Topic {
+		for _, name := range topic.Sinks {
+			if !slices.Contains(names, name) {
+				return fmt.Errorf("unknown sink '%s' for topic '%s'", name, topic.Name)
+			}
+			if err := m.checkRepublish(name, topic); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkRepublish check that entries republished to the MQTT server of the
+// mapping are not received again by a subscribed topic
+func (m *Mqtt2db) checkRepublish(name string, topic *Topic) error {
+	for _, config := range m.Sinks {
+		p := config.Republish
+		if config.Name != name || p == nil || (p.Mqtt != nil && p.Mqtt.Server != "") {
+			continue
+		}
+		publishTopic := p.publishTopic(topic)
+		for _, subscribed := range m.Topic {
+			if topicFilterMatch(subscribed.Name, publishTopic) {
+				return fmt.Errorf("republish topic '%s' of sink '%s' matches subscribed topic '%s'",
+					publishTopic, name, subscribed.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// sinkNames names of the sinks of the topic
+func (topic *Topic) sinkNames() []string {
+	if len(topic.Sinks) > 0 {
+		return topic.Sinks
+	}
+	return []string{DatabaseSink}
+}
+
+// outputName name of the topic used for files and republished topics
+func (topic *Topic) outputName() string {
+	if topic.StoreTablename != "" {
+		return topic.StoreTablename
+	}
+	return outputNameReplacer.Replace(topic.Name)
+}
+
+func (topic *Topic) usesDatabase() bool {
+	return slices.Contains(topic.sinkNames(), DatabaseSink)
+}
+
+// usesDatabase check if any topic stores into the database of the mapping
+func (m *Mqtt2db) usesDatabase() bool {
+	return slices.ContainsFunc(m.Topic, (*Topic).usesDatabase)
+}
+
+// store write the entries into all sinks of the topic. Errors of the
+// database sink are fatal, errors of other sinks are logged.
+func (topic *Topic) store(entries []map[string]interface{}) {
+	s := topic.service
+	for _, name := range topic.sinkNames() {
+		sink, err := s.sink(name)
+		if err == nil {
+			err = sink.Write(topic, entries)
+		}
+		if err != nil {
+			if name == DatabaseSink {
+				s.fail(fmt.Errorf("error inserting record: %v", err))
+				return
+			}
+			log.Log.Errorf("Error writing into sink %s: %v", name, err)
+		}
+	}
+	for _, e := range entries {
+		if topic.usesDatabase() {
+			topic.markRollup(e)
+		}
+		if s.config.Hooks.OnStored != nil {
+			s.config.Hooks.OnStored(topic, e)
+		}
+	}
+}
+
+// openedSinks copy of the opened sinks, the sinks are flushed and checked
+// without holding the lock needed by storing
+func (s *Service) openedSinks() map[string]Sink {
+	s.sinkLock.Lock()
+	defer s.sinkLock.Unlock()
+	return maps.Clone(s.sinks)
+}
+
+// flushSinks write the buffered entries of all opened sinks
+func (s *Service) flushSinks() {
+	for name, sink := range s.openedSinks() {
+		if err := sink.Flush(); err != nil {
+			log.Log.Errorf("Error flushing sink %s: %v", name, err)
+		}
+	}
+}
+
+// closeSinks close all sinks opened by the service. The sinks passed by the
+// service configuration are only flushed, they are closed by the caller.
+func (s *Service) closeSinks() {
+	s.sinkLock.Lock()
+	sinks := s.sinks
+	s.sinks = make(map[string]Sink)
+	s.sinkLock.Unlock()
+	for name, sink := range sinks {
+		if _, ok := s.config.Sinks[name]; ok {
+			if err := sink.Flush(); err != nil {
+				log.Log.Errorf("Error flushing sink %s: %v", name, err)
+			}
+			continue
+		}
+		if err := sink.Close(); err != nil {
+			log.Log.Errorf("Error closing sink %s: %v", name, err)
+		}
+	}
+}
+
+// loopSinkFlush periodically write the buffered entries of the sinks
+func (s *Service) loopSinkFlush() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-time.After(sinkFlushInterval):
+			s.flushSinks()
+		}
+	}
+}
+
+// sinkProblems health errors of all opened sinks
+func (s *Service) sinkProblems() []string {
+	sinks := s.openedSinks()
+	problems := make([]string, 0)
+	for _, name := range sortedKeys(sinks) {
+		if sink, ok := sinks[name].(*sqlSink); ok && sink.id == nil {
+			// reported by the database check
+			continue
+		}
+		if err := sinks[name].Health(); err != nil {
+			problems = append(problems, fmt.Sprintf("sink %s: %v", name, err))
+		}
+	}
+	return problems
+}
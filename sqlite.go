@@ -0,0 +1,449 @@
+/*
+* Copyright 2023-2025 Thorsten A. Knieling
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*    http://www.apache.org/licenses/LICENSE-2.0
+*
+ */
+
+package mqtt2db
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/tknie/flynn/common"
+	"github.com/tknie/flynn/dbsql"
+	"github.com/tknie/log"
+
+	// pure Go SQLite driver registered as 'sqlite'
+	_ "modernc.org/sqlite"
+)
+
+const (
+	sqliteTimeLayout         = "2006-01-02 15:04:05.999999999"
+	sqliteBusyTimeout        = 5000
+	sqliteCheckpointInterval = 5 * time.Minute
+	insertedOnColumn         = "inserted_on"
+)
+
+// sqliteDB database client storing into a SQLite file. The database is
+// used in WAL mode and checkpointed periodically. Time stamps are stored
+// as UTC text comparable with the search criteria, see sqlTime.
+type sqliteDB struct {
+	path string
+	db   *sql.DB
+	done chan struct{}
+}
+
+// sqlitePath file path of the SQLite database URL. Accepted are
+// 'sqlite:<path>', 'file:<path>' or a plain path.
+func sqlitePath(dbURL string) (string, bool) {
+	for _, prefix := range []string{"sqlite://", "sqlite:", "file:"} {
+		if strings.HasPrefix(dbURL, prefix) {
+			return strings.TrimPrefix(dbURL, prefix), true
+		}
+	}
+	if dbURL == "" || strings.Contains(dbURL, "://") {
+		return "", false
+	}
+	return dbURL, strings.HasPrefix(dbURL, "/") || strings.HasPrefix(dbURL, ".") ||
+		strings.HasSuffix(dbURL, ".db") || strings.HasSuffix(dbURL, ".sqlite") ||
+		strings.HasSuffix(dbURL, ".sqlite3")
+}
+
+// openSQLite open the SQLite database file, the file is created if not
+// available
+func openSQLite(path string) (*sqliteDB, error) {
+	dsn := fmt.Sprintf("file:%s?_txlock=immediate&_pragma=journal_mode(WAL)&_pragma=busy_timeout(%d)&_pragma=synchronous(NORMAL)",
+		(&url.URL{Path: path}).EscapedPath(), sqliteBusyTimeout)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("SQLite database %s: %v", path, err)
+	}
+	s := &sqliteDB{path: path, db: db, done: make(chan struct{})}
+	go s.loopCheckpoint()
+	return s, nil
+}
+
+// loopCheckpoint periodically write the WAL into the database file
+func (s *sqliteDB) loopCheckpoint() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-time.After(sqliteCheckpointInterval):
+			if err := s.checkpoint(); err != nil {
+				log.Log.Errorf("SQLite checkpoint of %s failed: %v", s.path, err)
+			}
+		}
+	}
+}
+
+func (s *sqliteDB) checkpoint() error {
+	_, err := s.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
+	return err
+}
+
+// sqliteInit create the index of the insert time of a new SQLite table.
+// The insert time is set by the column default, no trigger is needed.
+func sqliteInit(id DatabaseClient, table string) error {
+	return id.Batch(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_inserted_on_idx ON %s (%s)",
+		table, table, insertedOnColumn))
+}
+
+func (s *sqliteDB) CreateTableIfNotExists(tableName string, columns any) (common.CreateStatus, error) {
+	tables, err := s.Tables()
+	if err != nil {
+		return common.CreateError, err
+	}
+	if slices.ContainsFunc(tables, func(t string) bool { return strings.EqualFold(t, tableName) }) {
+		return common.CreateExists, nil
+	}
+	cols, ok := columns.([]*common.Column)
+	if !ok {
+		return common.CreateError, fmt.Errorf("SQLite table columns type %T not supported", columns)
+	}
+	var buffer bytes.Buffer
+	buffer.WriteString("CREATE TABLE IF NOT EXISTS " + tableName + " (id INTEGER PRIMARY KEY AUTOINCREMENT")
+	for _, c := range cols {
+		if strings.EqualFold(c.Name, "id") || strings.EqualFold(c.Name, insertedOnColumn) {
+			continue
+		}
+		buffer.WriteString(", ")
+		sqliteColumn(&buffer, c)
+	}
+	buffer.WriteString(", " + insertedOnColumn + " TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')))")
+	_, err = s.db.Exec(buffer.String())
+	if err != nil {
+		return common.CreateError, err
+	}
+	return common.CreateCreated, nil
+}
+
+// sqliteColumn column definition, binary data is stored unchanged without
+// length limit
+func sqliteColumn(buffer *bytes.Buffer, c *common.Column) {
+	if c.DataType == common.Bytes {
+		buffer.WriteString(c.Name + " BLOB")
+		return
+	}
+	dbsql.CreateTableByColumn(buffer, false, c)
+}
+
+func (s *sqliteDB) DeleteTable(tableName string) error {
+	_, err := s.db.Exec("DROP TABLE IF EXISTS " + tableName)
+	return err
+}
+
+func (s *sqliteDB) Batch(batch string) error {
+	_, err := s.db.Exec(batch)
+	return err
+}
+
+func (s *sqliteDB) Ping() error {
+	return s.db.Ping()
+}
+
+// Insert insert the rows in one transaction. A row is either one map of
+// the field values or the values in field order.
+func (s *sqliteDB) Insert(name string, insert *common.Entries) ([][]any, error) {
+	if len(insert.Values) == 0 {
+		return nil, nil
+	}
+	cmd := "INSERT INTO " + name + " (" + sqliteQuote(insert.Fields) + ") VALUES (" +
+		strings.TrimSuffix(strings.Repeat("?,", len(insert.Fields)), ",") + ")"
+	err := s.transaction(func(tx *sql.Tx) error {
+		for _, row := range insert.Values {
+			_, err := tx.Exec(cmd, sqliteArgs(insert.Fields, row)...)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return nil, err
+}
+
+// Update update the rows selected by the fields listed in Update
+func (s *sqliteDB) Update(name string, insert *common.Entries) ([][]any, int64, error) {
+	var set, where []string
+	var setIndex, whereIndex []int
+	for i, f := range insert.Fields {
+		if slices.ContainsFunc(insert.Update, func(u string) bool { return strings.EqualFold(u, f) }) {
+			where = append(where, `"`+f+`" = ?`)
+			whereIndex = append(whereIndex, i)
+		} else {
+			set = append(set, `"`+f+`" = ?`)
+			setIndex = append(setIndex, i)
+		}
+	}
+	if len(where) == 0 || len(set) == 0 {
+		return nil, 0, fmt.Errorf("SQLite update needs key and value fields")
+	}
+	cmd := "UPDATE " + name + " SET " + strings.Join(set, ", ") + " WHERE " + strings.Join(where, " AND ")
+	affected := int64(0)
+	err := s.transaction(func(tx *sql.Tx) error {
+		for _, row := range insert.Values {
+			values := sqliteArgs(insert.Fields, row)
+			args := make([]any, 0, len(values))
+			for _, i := range append(slices.Clone(setIndex), whereIndex...) {
+				args = append(args, values[i])
+			}
+			res, err := tx.Exec(cmd, args...)
+			if err != nil {
+				return err
+			}
+			n, _ := res.RowsAffected()
+			affected += n
+		}
+		return nil
+	})
+	return nil, affected, err
+}
+
+func (s *sqliteDB) Delete(name string, remove *common.Entries) (int64, error) {
+	if remove.Criteria == "" {
+		return 0, fmt.Errorf("SQLite delete needs criteria")
+	}
+	res, err := s.db.Exec("DELETE FROM " + name + " WHERE " + remove.Criteria)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// removeRows delete the rows with the column until last in one
+// transaction, with move table the rows are copied before
+func (s *sqliteDB) removeRows(table, moveTable, column string, last time.Time) (int64, error) {
+	statement := fmt.Sprintf(`DELETE FROM %s WHERE "%s" <= ?`, table, column)
+	affected := int64(0)
+	err := s.transaction(func(tx *sql.Tx) error {
+		if moveTable != "" {
+			_, err := tx.Exec(fmt.Sprintf(`INSERT INTO %s SELECT * FROM %s WHERE "%s" <= ?`,
+				moveTable, table, column), sqliteArg(last))
+			if err != nil {
+				return err
+			}
+		}
+		res, err := tx.Exec(statement, sqliteArg(last))
+		if err != nil {
+			return err
+		}
+		affected, err = res.RowsAffected()
+		return err
+	})
+	return affected, err
+}
+
+// Query call the result function for each row of the query. Only queries
+// with fields are supported.
+func (s *sqliteDB) Query(query *common.Query, f common.ResultFunction) (*common.Result, error) {
+	if query.DataStruct != nil {
+		return nil, fmt.Errorf("SQLite query with data struct not supported")
+	}
+	var buffer bytes.Buffer
+	buffer.WriteString("SELECT " + strings.Join(query.Fields, ", ") + " FROM " + query.TableName)
+	if query.Search != "" {
+		buffer.WriteString(" WHERE " + query.Search)
+	}
+	if len(query.Order) > 0 {
+		order := make([]string, 0, len(query.Order))
+		for _, o := range query.Order {
+			order = append(order, strings.Replace(o, ":", " ", 1))
+		}
+		buffer.WriteString(" ORDER BY " + strings.Join(order, ", "))
+	}
+	if query.Limit != "" {
+		buffer.WriteString(" LIMIT " + query.Limit)
+	}
+	rows, err := s.db.Query(buffer.String(), query.Parameters...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := &common.Result{}
+	result.Fields, err = rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		values := make([]any, len(result.Fields))
+		pointers := make([]any, len(values))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		err = rows.Scan(pointers...)
+		if err != nil {
+			return nil, err
+		}
+		for i, v := range values {
+			values[i] = sqliteValue(types[i].DatabaseTypeName(), v)
+		}
+		result.Counter++
+		result.Rows = values
+		err = f(query, result)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, rows.Err()
+}
+
+func (s *sqliteDB) GetTableColumn(tableName string) ([]string, error) {
+	rows, err := s.db.Query("SELECT name FROM pragma_table_info(?)", tableName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns = append(columns, name)
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("table %s not found", tableName)
+	}
+	return columns, rows.Err()
+}
+
+func (s *sqliteDB) Tables() ([]string, error) {
+	rows, err := s.db.Query("SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tables := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		tables = append(tables, name)
+	}
+	return tables, rows.Err()
+}
+
+// FreeHandler checkpoint and close the database
+func (s *sqliteDB) FreeHandler() error {
+	select {
+	case <-s.done:
+		return nil
+	default:
+	}
+	close(s.done)
+	if err := s.checkpoint(); err != nil {
+		log.Log.Errorf("SQLite checkpoint of %s failed: %v", s.path, err)
+	}
+	return s.db.Close()
+}
+
+func (s *sqliteDB) transaction(f func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = f(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func sqliteQuote(fields []string) string {
+	quoted := make([]string, len(fields))
+	for i, f := range fields {
+		quoted[i] = `"` + f + `"`
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// sqliteArgs statement arguments of the row in field order
+func sqliteArgs(fields []string, row []any) []any {
+	values := row
+	if len(row) == 1 {
+		if m, ok := row[0].(map[string]interface{}); ok {
+			values = make([]any, len(fields))
+			for i, f := range fields {
+				values[i] = m[f]
+			}
+		}
+	}
+	args := make([]any, len(values))
+	for i, v := range values {
+		args[i] = sqliteArg(v)
+	}
+	return args
+}
+
+// sqlTime time literal of search criteria. SQLite stores the time stamps
+// as UTC text, which is unambiguous during the daylight saving change.
+func sqlTime(id DatabaseClient, t time.Time, layout string) string {
+	if _, ok := id.(*sqliteDB); ok {
+		return t.UTC().Format(layout)
+	}
+	return t.Format(layout)
+}
+
+// sqliteArg convert time stamps into comparable UTC text
+func sqliteArg(v any) any {
+	switch x := v.(type) {
+	case time.Time:
+		return x.UTC().Format(sqliteTimeLayout)
+	case *time.Time:
+		if x == nil {
+			return nil
+		}
+		return x.UTC().Format(sqliteTimeLayout)
+	case driver.Valuer:
+		if dv, err := x.Value(); err == nil {
+			return sqliteArg(dv)
+		}
+	}
+	return v
+}
+
+// sqliteValue convert the scanned value, the stored UTC time stamps are
+// returned in local time
+func sqliteValue(dbType string, v any) any {
+	switch x := v.(type) {
+	case time.Time:
+		return time.Date(x.Year(), x.Month(), x.Day(), x.Hour(), x.Minute(), x.Second(),
+			x.Nanosecond(), time.UTC).Local()
+	case string:
+		switch strings.ToUpper(dbType) {
+		case "", "TIMESTAMP", "DATETIME", "DATE":
+			if t, err := time.ParseInLocation(sqliteTimeLayout, x, time.UTC); err == nil {
+				return t.Local()
+			}
+		}
+	case []byte:
+		// tables of former versions use BINARY columns
+		if t := strings.ToUpper(dbType); t != "BLOB" && !strings.Contains(t, "BINARY") {
+			return string(x)
+		}
+	}
+	return v
+}
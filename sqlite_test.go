@@ -0,0 +1,196 @@
+/*
+* Copyright 2023-2025 Thorsten A. Knieling
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*    http://www.apache.org/licenses/LICENSE-2.0
+*
+ */
+
+package mqtt2db
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tknie/flynn/common"
+)
+
+func newSQLiteTest(t *testing.T) *sqliteDB {
+	db, err := openSQLite(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("open SQLite: %v", err)
+	}
+	t.Cleanup(func() { db.FreeHandler() })
+	columns := make([]*common.Column, 0)
+	for _, c := range []struct{ name, fdType string }{{"Time", "time.Time"}, {"Name", "string"},
+		{"Power", "float64"}, {"Active", "bool"}, {"Data", "bytes"}} {
+		mt, err := parseType(c.fdType)
+		if err != nil {
+			t.Fatalf("parse type %s: %v", c.fdType, err)
+		}
+		columns = append(columns, mt.column(c.name))
+	}
+	for _, want := range []common.CreateStatus{common.CreateCreated, common.CreateExists} {
+		status, err := db.CreateTableIfNotExists("entries", columns)
+		if err != nil || status != want {
+			t.Fatalf("create table status=%v err=%v, want %v", status, err, want)
+		}
+	}
+	return db
+}
+
+// sqliteRows query the rows of the entries table ordered by time
+func sqliteRows(t *testing.T, db *sqliteDB, search string) [][]any {
+	rows := make([][]any, 0)
+	_, err := db.Query(&common.Query{TableName: "entries",
+		Fields: []string{"Time", "Name", "Power", "Active", "Data", insertedOnColumn},
+		Search: search, Order: []string{"Time:ASC"}},
+		func(search *common.Query, result *common.Result) error {
+			rows = append(rows, append([]any{}, result.Rows...))
+			return nil
+		})
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	return rows
+}
+
+func TestSQLiteRoundTrip(t *testing.T) {
+	db := newSQLiteTest(t)
+	// both time stamps are 02:30 local time in central Europe, the hour is
+	// repeated by the daylight saving change
+	first := time.Date(2025, 10, 26, 0, 30, 0, 123456789, time.UTC)
+	second := first.Add(time.Hour)
+	fields := []string{"Active", "Data", "Name", "Power", "Time"}
+	_, err := db.Insert("entries", &common.Entries{Fields: fields, Values: [][]any{
+		{map[string]interface{}{"Time": second.In(time.Local), "Name": "b", "Power": 2.5,
+			"Active": false, "Data": []byte{0, 1}}},
+		{map[string]interface{}{"Time": first, "Name": "a", "Power": 12.5,
+			"Active": true, "Data": []byte{0xff, 0, 0x80}}},
+	}})
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+
+	rows := sqliteRows(t, db, "")
+	if len(rows) != 2 {
+		t.Fatalf("query returned %d rows, want 2", len(rows))
+	}
+	for i, want := range []struct {
+		time   time.Time
+		name   string
+		power  float64
+		active bool
+		data   []byte
+	}{{first, "a", 12.5, true, []byte{0xff, 0, 0x80}}, {second, "b", 2.5, false, []byte{0, 1}}} {
+		row := rows[i]
+		if ts, ok := row[0].(time.Time); !ok || !ts.Equal(want.time) || ts.Location() != time.Local {
+			t.Errorf("row %d time %#v, want %v in local time", i, row[0], want.time)
+		}
+		if row[1] != want.name {
+			t.Errorf("row %d name %#v, want %s", i, row[1], want.name)
+		}
+		if f, ok := toFloat64(row[2]); !ok || f != want.power {
+			t.Errorf("row %d power %#v, want %v", i, row[2], want.power)
+		}
+		if b, err := convertBool(nil, row[3]); err != nil || b != want.active {
+			t.Errorf("row %d active %#v, want %v", i, row[3], want.active)
+		}
+		if b, ok := row[4].([]byte); !ok || !bytes.Equal(b, want.data) {
+			t.Errorf("row %d data %#v, want %v", i, row[4], want.data)
+		}
+		if ts, ok := row[5].(time.Time); !ok || time.Since(ts) > time.Minute || time.Since(ts) < -time.Minute {
+			t.Errorf("row %d inserted_on %#v, want current time", i, row[5])
+		}
+	}
+
+	search := fmt.Sprintf("Time >= '%s'", sqlTime(db, second, sqlTimeLayout))
+	if rows = sqliteRows(t, db, search); len(rows) != 1 || rows[0][1] != "b" {
+		t.Errorf("search %s returned %v, want row b", search, rows)
+	}
+}
+
+func TestSQLiteUpdateDelete(t *testing.T) {
+	db := newSQLiteTest(t)
+	now := time.Now()
+	_, err := db.Insert("entries", &common.Entries{Fields: []string{"Name", "Power", "Time"},
+		Values: [][]any{{"a", 1.0, now}, {"b", 2.0, now.Add(time.Second)}}})
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+
+	_, affected, err := db.Update("entries", &common.Entries{Fields: []string{"Name", "Power"},
+		Update: []string{"Name"}, Values: [][]any{{"b", 20.0}}})
+	if err != nil || affected != 1 {
+		t.Fatalf("update affected=%d err=%v, want 1", affected, err)
+	}
+	rows := sqliteRows(t, db, "")
+	if f, _ := toFloat64(rows[1][2]); len(rows) != 2 || f != 20 {
+		t.Errorf("rows after update %v", rows)
+	}
+	if f, _ := toFloat64(rows[0][2]); f != 1 {
+		t.Errorf("row a changed by update: %v", rows[0])
+	}
+
+	if _, err = db.Delete("entries", &common.Entries{}); err == nil {
+		t.Errorf("delete without criteria accepted")
+	}
+	deleted, err := db.Delete("entries", &common.Entries{Criteria: "Name = 'a'"})
+	if err != nil || deleted != 1 {
+		t.Fatalf("delete deleted=%d err=%v, want 1", deleted, err)
+	}
+	if rows = sqliteRows(t, db, ""); len(rows) != 1 || rows[0][1] != "b" {
+		t.Errorf("rows after delete %v", rows)
+	}
+}
+
+func TestSQLiteAdaptTable(t *testing.T) {
+	url := "sqlite:" + filepath.Join(t.TempDir(), "home.db")
+	mapping := func(entries ...MappingEntry) *Mqtt2db {
+		return &Mqtt2db{Database: Database{Url: url},
+			Topic: []*Topic{{Name: "home/power", StoreTablename: "power", Mapping: entries}}}
+	}
+	power := MappingEntry{Source: "Power", Destination: "Power", Type: "float64"}
+	for _, m := range []*Mqtt2db{mapping(power),
+		mapping(power, MappingEntry{Source: "Energy", Destination: "Energy", Type: "float64", Counter: &Counter{}},
+			MappingEntry{Source: "Data", Destination: "Data", Type: "bytes"})} {
+		s, err := NewService(&ServiceConfig{Mapping: m, Create: true, MQTT: &fakeMQTT{},
+			Hooks: Hooks{OnError: func(err error) { t.Errorf("unexpected error: %v", err) }}})
+		if err != nil {
+			t.Fatalf("NewService: %v", err)
+		}
+		if err = s.Start(context.Background()); err != nil {
+			t.Fatalf("Start: %v", err)
+		}
+		s.Stop()
+	}
+
+	db, err := openSQLite(strings.TrimPrefix(url, "sqlite:"))
+	if err != nil {
+		t.Fatalf("open SQLite: %v", err)
+	}
+	defer db.FreeHandler()
+	columns, err := db.GetTableColumn("power")
+	if err != nil {
+		t.Fatalf("table columns: %v", err)
+	}
+	for _, column := range []string{"Power", "Energy", "Energy_delta", "Energy_rate", "Data"} {
+		if !slices.Contains(columns, column) {
+			t.Errorf("column %s missing in %v", column, columns)
+		}
+	}
+	var declared string
+	err = db.db.QueryRow("SELECT type FROM pragma_table_info('power') WHERE name = 'Data'").Scan(&declared)
+	if err != nil || declared != "BLOB" {
+		t.Errorf("Data column type %q err=%v, want BLOB", declared, err)
+	}
+}
@@ -0,0 +1,66 @@
+/*
+* Copyright 2023-2025 Thorsten A. Knieling
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*    http://www.apache.org/licenses/LICENSE-2.0
+*
+ */
+
+package mqtt2db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/tknie/log"
+)
+
+// ReceiveTimeSource mapping source keyword referencing the time the
+// message was received from the MQTT broker
+const ReceiveTimeSource = "$receiveTime"
+
+const (
+	skewCorrect = "correct"
+	skewReject  = "reject"
+)
+
+// Timestamp per topic rule defining the time stamp of a stored entry. The
+// payload time is used if present and plausible, else the receive time.
+type Timestamp struct {
+	Destination string        `yaml:"destination"`
+	MaxFuture   time.Duration `yaml:"maxFuture,omitempty"`
+	MaxPast     time.Duration `yaml:"maxPast,omitempty"`
+	OnSkew      string        `yaml:"onSkew,omitempty"`
+}
+
+// adapt check the time stamp of the entry against the receive time. If the
+// time stamp is missing the receive time is set. Returns an error if the
+// entry need to be rejected.
+func (ts *Timestamp) adapt(topicName string, e map[string]interface{}, received time.Time) error {
+	if ts.Destination == "" {
+		return nil
+	}
+	t, ok := e[ts.Destination].(time.Time)
+	if !ok {
+		log.Log.Debugf("No time stamp in %s for topic %s, use receive time", ts.Destination, topicName)
+		e[ts.Destination] = received
+		return nil
+	}
+	skew := t.Sub(received)
+	switch {
+	case ts.MaxFuture > 0 && skew > ts.MaxFuture:
+	case ts.MaxPast > 0 && -skew > ts.MaxPast:
+	default:
+		return nil
+	}
+	if ts.OnSkew == skewReject {
+		return fmt.Errorf("time stamp %s skew %v", t.Format(layout), skew)
+	}
+	log.Log.Infof("Correct time stamp %s of topic %s to receive time (skew %v)",
+		t.Format(layout), topicName, skew)
+	e[ts.Destination] = received
+	return nil
+}
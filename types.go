@@ -0,0 +1,280 @@
+/*
+* Copyright 2023-2025 Thorsten A. Knieling
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*    http://www.apache.org/licenses/LICENSE-2.0
+*
+ */
+
+package mqtt2db
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tknie/flynn/common"
+)
+
+const nullableSuffix = "?"
+
+const (
+	defaultDecimalLength = 18
+	defaultDecimalDigits = 4
+)
+
+var decimalRegexp = regexp.MustCompile(`^decimal\((\d+),(\d+)\)$`)
+
+// mappingType mapping type definition containing the column definition
+// and the coercion of received values
+type mappingType struct {
+	name     string
+	nullable bool
+	dataType common.DataType
+	length   uint16
+	digits   uint8
+	jsonb    bool
+	convert  func(mt *mappingType, i interface{}) (interface{}, error)
+}
+
+// parseType parse mapping type name. Nullable variants are defined with
+// a '?' suffix like 'int64?'.
+func parseType(fdType string) (*mappingType, error) {
+	name := strings.TrimSpace(fdType)
+	mt := &mappingType{name: name}
+	if strings.HasSuffix(name, nullableSuffix) {
+		mt.nullable = true
+		name = strings.TrimSuffix(name, nullableSuffix)
+		mt.name = name
+	}
+	switch name {
+	case "bool":
+		mt.dataType = common.Boolean
+		mt.convert = convertBool
+	case "int32":
+		mt.dataType = common.Integer
+		mt.convert = convertInt32
+	case "int64":
+		mt.dataType = common.Number
+		mt.length = 8
+		mt.convert = convertInt64
+	case "float64":
+		mt.dataType = common.Decimal
+		mt.length = 10
+		mt.convert = convertFloat64
+	case "decimal":
+		mt.dataType = common.Decimal
+		mt.length = defaultDecimalLength
+		mt.digits = defaultDecimalDigits
+		mt.convert = convertDecimal
+	case "string":
+		mt.dataType = common.Alpha
+		mt.length = 255
+		mt.convert = convertString
+	case "time.Time":
+		mt.dataType = common.CurrentTimestamp
+		mt.convert = convertTime
+	case "json", "jsonb":
+		mt.dataType = common.Text
+		mt.jsonb = name == "jsonb"
+		mt.convert = convertJSON
+	case "bytes":
+		mt.dataType = common.Bytes
+		mt.length = 1024
+		mt.convert = convertBytes
+	default:
+		match := decimalRegexp.FindStringSubmatch(name)
+		if match == nil {
+			return nil, fmt.Errorf("unknown data type '%s'", fdType)
+		}
+		l, err := strconv.ParseUint(match[1], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid decimal length '%s': %v", fdType, err)
+		}
+		d, err := strconv.ParseUint(match[2], 10, 8)
+		if err != nil || d > l {
+			return nil, fmt.Errorf("invalid decimal digits '%s'", fdType)
+		}
+		mt.name = "decimal"
+		mt.dataType = common.Decimal
+		mt.length = uint16(l)
+		mt.digits = uint8(d)
+		mt.convert = convertDecimal
+	}
+	return mt, nil
+}
+
+// column create database column definition
+func (mt *mappingType) column(name string) *common.Column {
+	return &common.Column{Name: name, DataType: mt.dataType, Length: mt.length, Digits: mt.digits}
+}
+
+// value convert received value into mapping type. JSON null values are
+// only valid for nullable types.
+func (mt *mappingType) value(i interface{}) (interface{}, error) {
+	if i == nil {
+		if mt.nullable {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("null value for non-nullable type %s", mt.name)
+	}
+	return mt.convert(mt, i)
+}
+
+func convertBool(mt *mappingType, i interface{}) (interface{}, error) {
+	switch v := i.(type) {
+	case bool:
+		return v, nil
+	case float64:
+		return v != 0, nil
+	case int64:
+		return v != 0, nil
+	case string:
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "1", "true", "on", "yes":
+			return true, nil
+		case "0", "false", "off", "no":
+			return false, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown value for bool mapping: %T %v", i, i)
+}
+
+func convertInt64(mt *mappingType, i interface{}) (interface{}, error) {
+	switch v := i.(type) {
+	case float64:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case bool:
+		if v {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case string:
+		s := strings.TrimSpace(v)
+		if i64, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i64, nil
+		}
+		if fl64, err := strconv.ParseFloat(s, 64); err == nil {
+			return int64(fl64), nil
+		}
+	}
+	return nil, fmt.Errorf("unknown value for %s mapping: %T %v", mt.name, i, i)
+}
+
+func convertInt32(mt *mappingType, i interface{}) (interface{}, error) {
+	v, err := convertInt64(mt, i)
+	if err != nil {
+		return nil, err
+	}
+	i64 := v.(int64)
+	if i64 > math.MaxInt32 || i64 < math.MinInt32 {
+		return nil, fmt.Errorf("value %d out of range for int32 mapping", i64)
+	}
+	return int32(i64), nil
+}
+
+func convertFloat64(mt *mappingType, i interface{}) (interface{}, error) {
+	switch v := i.(type) {
+	case float64:
+		return v, nil
+	case int64:
+		return float64(v), nil
+	case bool:
+		if v {
+			return float64(1), nil
+		}
+		return float64(0), nil
+	case string:
+		if fl64, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+			return fl64, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown value for %s mapping: %T %v", mt.name, i, i)
+}
+
+func convertDecimal(mt *mappingType, i interface{}) (interface{}, error) {
+	v, err := convertFloat64(mt, i)
+	if err != nil {
+		return nil, err
+	}
+	scale := math.Pow10(int(mt.digits))
+	fl64 := math.Round(v.(float64)*scale) / scale
+	if math.Abs(fl64) >= math.Pow10(int(mt.length)-int(mt.digits)) {
+		return nil, fmt.Errorf("value %v exceeds decimal(%d,%d)", fl64, mt.length, mt.digits)
+	}
+	return fl64, nil
+}
+
+func convertString(mt *mappingType, i interface{}) (interface{}, error) {
+	switch v := i.(type) {
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case time.Time:
+		return v.Format(layout), nil
+	}
+	return convertJSON(mt, i)
+}
+
+func convertTime(mt *mappingType, i interface{}) (interface{}, error) {
+	switch v := i.(type) {
+	case time.Time:
+		return v, nil
+	case float64:
+		sec, frac := math.Modf(v)
+		return time.Unix(int64(sec), int64(frac*1e9)), nil
+	case int64:
+		return time.Unix(v, 0), nil
+	case string:
+		l := layout
+		if strings.HasSuffix(v, "Z") {
+			l = uatLayout
+		}
+		tn, err := time.ParseInLocation(l, v, time.Local)
+		if err != nil {
+			tn, err = time.Parse(time.RFC3339, v)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parse time location failed: %v", err)
+		}
+		return tn, nil
+	}
+	return nil, fmt.Errorf("unknown value for time.Time mapping: %T %v", i, i)
+}
+
+func convertJSON(mt *mappingType, i interface{}) (interface{}, error) {
+	b, err := json.Marshal(i)
+	if err != nil {
+		return nil, fmt.Errorf("error marshal %s mapping: %v", mt.name, err)
+	}
+	return string(b), nil
+}
+
+func convertBytes(mt *mappingType, i interface{}) (interface{}, error) {
+	switch v := i.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		b, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding base64 mapping: %v", err)
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("unknown value for bytes mapping: %T %v", i, i)
+}
@@ -0,0 +1,82 @@
+/*
+* Copyright 2023-2025 Thorsten A. Knieling
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*    http://www.apache.org/licenses/LICENSE-2.0
+*
+ */
+
+package mqtt2db
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+)
+
+var errInvalid = errors.New("validation failed")
+
+// initValidation check validation rules of the mapping entry
+func (e *MappingEntry) initValidation() error {
+	if e.Min != nil || e.Max != nil {
+		switch e.mtype.name {
+		case "int32", "int64", "float64", "decimal":
+		default:
+			return fmt.Errorf("min/max not valid for type '%s' of %s", e.Type, e.Source)
+		}
+	}
+	if e.Regex != "" {
+		re, err := regexp.Compile(e.Regex)
+		if err != nil {
+			return fmt.Errorf("invalid regex of %s: %v", e.Source, err)
+		}
+		e.regex = re
+	}
+	return nil
+}
+
+// validate check the converted value against the validation rules of the
+// mapping entry
+func (e *MappingEntry) validate(f interface{}) error {
+	if f == nil {
+		if e.Required {
+			return fmt.Errorf("%w: required value is null", errInvalid)
+		}
+		return nil
+	}
+	if e.Min != nil || e.Max != nil {
+		var v float64
+		switch n := f.(type) {
+		case int32:
+			v = float64(n)
+		case int64:
+			v = float64(n)
+		case float64:
+			v = n
+		}
+		if e.Min != nil && v < *e.Min {
+			return fmt.Errorf("%w: value %v below minimum %v", errInvalid, f, *e.Min)
+		}
+		if e.Max != nil && v > *e.Max {
+			return fmt.Errorf("%w: value %v above maximum %v", errInvalid, f, *e.Max)
+		}
+	}
+	if e.regex == nil && len(e.Enum) == 0 {
+		return nil
+	}
+	s, ok := f.(string)
+	if !ok {
+		s = fmt.Sprintf("%v", f)
+	}
+	if e.regex != nil && !e.regex.MatchString(s) {
+		return fmt.Errorf("%w: value '%s' does not match '%s'", errInvalid, s, e.Regex)
+	}
+	if len(e.Enum) > 0 && !slices.Contains(e.Enum, s) {
+		return fmt.Errorf("%w: value '%s' not in %v", errInvalid, s, e.Enum)
+	}
+	return nil
+}